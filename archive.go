@@ -0,0 +1,869 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/golang/snappy"
+	"github.com/hashicorp/raft"
+)
+
+// ErrCorruptArchive is matched by errors.Is for every error about the content
+// of an archive segment or its index.
+var ErrCorruptArchive = errors.New("corrupt log archive")
+
+// ErrNoArchive is returned by PebbleStore.LogArchive when ArchiveDir is not
+// configured.
+var ErrNoArchive = errors.New("no log archive configured")
+
+// An archived segment is a pair of files named after the first and last
+// index they hold, <first>-<last>.seg and <first>-<last>.idx, both zero
+// padded to 20 digits so they sort by index. The index file is written last:
+// a segment without one was interrupted and is not part of the archive.
+//
+// A segment holding indexes that were already archived, because the log was
+// rewritten after they were, is named <first>-<last>-<gen>, with gen above
+// that of every segment before it. Where segments overlap, the entries of the
+// one with the highest gen are the archived ones.
+//
+// The segment file is
+//
+//	magic(4) version(1) compression(1) encrypted(1)
+//	blocks: len(payload)(4) crc32c(payload)(4) payload
+//
+// A block holds up to archiveBlockSize bytes of entries, each encoded as
+// len(entry)(uvarint) entry with the uncompressed binary codec. Its payload
+// is the block compressed as a whole and, when the store is encrypted, then
+// sealed with the store's keys, bound to the group, the segment's gen and
+// the first and last index of the block. The index file is
+//
+//	magic(4) version(1)
+//	blocks: first(8) last(8) offset(8) len(payload)(4) len(block)(4)
+//	crc32c(everything before)(4)
+//
+// with every number big endian, so a range is read without decoding the
+// blocks before it.
+const (
+	archiveVersion    byte = 1
+	archiveBlockSize       = 64 * 1024
+	archiveRecordSize      = 32
+
+	archiveSegmentExt = ".seg"
+	archiveIndexExt   = ".idx"
+	archiveTempExt    = ".tmp"
+)
+
+var (
+	archiveSegmentMagic = []byte("RPAS")
+	archiveIndexMagic   = []byte("RPAI")
+)
+
+const (
+	archiveSegmentHeaderSize = 7
+	archiveFrameHeaderSize   = 8
+)
+
+// archiveCodec encodes archived entries: binary and never compressed, the
+// blocks are compressed instead.
+var archiveCodec = &logCodec{writer: CodecBinary, stats: &compressionStats{}}
+
+type archiveSegment struct {
+	first, last uint64
+	gen         uint64
+	name        string
+}
+
+// archiveSpan is a range of indexes read from seg, the segment with the
+// highest gen holding them.
+type archiveSpan struct {
+	first, last uint64
+	seg         archiveSegment
+}
+
+type archiveBlock struct {
+	first, last uint64
+	offset      uint64
+	length      uint32
+	rawLen      uint32
+}
+
+// logArchiver writes the entries DeleteRange removes from the front of a
+// store's log to segment files in dir.
+type logArchiver struct {
+	fs          vfs.FS
+	dir         string
+	namespace   []byte
+	compression Compression
+	cipher      *valueCipher
+
+	// mu serializes the segments written, outside the engine's writeMu.
+	// last is the last index archived and gen the highest gen of the
+	// segments, both guarded by mu. Entries up to last are only archived
+	// again when their term changed, not e.g. when a crash came between
+	// writing a segment and deleting its entries.
+	mu   sync.Mutex
+	last uint64
+	gen  uint64
+}
+
+// archivePath returns the archive directory of the store with namespace.
+func (e *PebbleEngine) archivePath(namespace []byte) string {
+	if len(namespace) == 0 {
+		return e.archiveDir
+	}
+	group := bytesToUint64(namespace[len(groupPrefix):])
+	return e.fs.PathJoin(e.archiveDir, fmt.Sprintf("group-%d", group))
+}
+
+// newLogArchiver picks up the segments already in the archive of the store
+// with namespace and, unless the engine is read-only, removes the files of
+// segments whose writing was interrupted.
+func newLogArchiver(e *PebbleEngine, namespace []byte) (*logArchiver, error) {
+	if e.archiveCompression > CompressionZstd {
+		return nil, fmt.Errorf("unknown archive compression %s", e.archiveCompression)
+	}
+
+	dir := e.archivePath(namespace)
+	a := &logArchiver{
+		fs:          e.fs,
+		dir:         dir,
+		namespace:   namespace,
+		compression: e.archiveCompression,
+		cipher:      e.cipher,
+	}
+
+	segments, names, err := listArchiveSegments(a.fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		a.last = max(a.last, seg.last)
+		a.gen = max(a.gen, seg.gen)
+	}
+
+	if e.readOnly {
+		return a, nil
+	}
+
+	complete := make(map[string]bool, len(segments))
+	for _, seg := range segments {
+		complete[seg.name] = true
+	}
+	for _, name := range names {
+		base := strings.TrimSuffix(name, archiveSegmentExt)
+		if strings.HasSuffix(name, archiveTempExt) || (base != name && !complete[base]) {
+			if err := a.fs.Remove(a.fs.PathJoin(dir, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// listArchiveSegments returns the complete segments in dir sorted by index,
+// and the names of all the files in it. A missing dir is an empty archive.
+func listArchiveSegments(fs vfs.FS, dir string) ([]archiveSegment, []string, error) {
+	names, err := fs.List(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var segments []archiveSegment
+	for _, name := range names {
+		base, ok := strings.CutSuffix(name, archiveIndexExt)
+		if !ok {
+			continue
+		}
+		var first, last, gen uint64
+		if n, _ := fmt.Sscanf(base, "%d-%d-%d", &first, &last, &gen); n < 2 || base != archiveSegmentName(first, last, gen) {
+			continue
+		}
+		segments = append(segments, archiveSegment{first: first, last: last, gen: gen, name: base})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].first != segments[j].first {
+			return segments[i].first < segments[j].first
+		}
+		return segments[i].gen < segments[j].gen
+	})
+
+	return segments, names, nil
+}
+
+func archiveSegmentName(first, last, gen uint64) string {
+	if gen == 0 {
+		return fmt.Sprintf("%020d-%020d", first, last)
+	}
+	return fmt.Sprintf("%020d-%020d-%d", first, last, gen)
+}
+
+// archiveSpans splits the indexes of segments into spans, each read from the
+// segment with the highest gen holding it, sorted by index.
+func archiveSpans(segments []archiveSegment) []archiveSpan {
+	byGen := append([]archiveSegment{}, segments...)
+	sort.SliceStable(byGen, func(i, j int) bool {
+		return byGen[i].gen > byGen[j].gen
+	})
+
+	// covered holds the disjoint ranges of the segments seen so far, sorted
+	var spans, covered []archiveSpan
+	for _, seg := range byGen {
+		next, rest := seg.first, true
+		for _, c := range covered {
+			if c.last < next {
+				continue
+			}
+			if c.first > seg.last {
+				break
+			}
+			if c.first > next {
+				spans = append(spans, archiveSpan{first: next, last: c.first - 1, seg: seg})
+			}
+			if c.last >= seg.last {
+				rest = false
+				break
+			}
+			next = c.last + 1
+		}
+		if rest {
+			spans = append(spans, archiveSpan{first: next, last: seg.last, seg: seg})
+		}
+
+		covered = append(covered, archiveSpan{first: seg.first, last: seg.last})
+		sort.Slice(covered, func(i, j int) bool {
+			return covered[i].first < covered[j].first
+		})
+		merged := covered[:1]
+		for _, c := range covered[1:] {
+			if prev := &merged[len(merged)-1]; c.first <= prev.last+1 {
+				prev.last = max(prev.last, c.last)
+			} else {
+				merged = append(merged, c)
+			}
+		}
+		covered = merged
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].first < spans[j].first
+	})
+
+	return spans
+}
+
+// archiveBlockAAD binds a sealed block to the group, the segment and the
+// entries its index record says it holds, so blocks cannot be swapped
+// around, within an archive or between the groups of an engine.
+func archiveBlockAAD(namespace []byte, gen, first, last uint64) []byte {
+	aad := append([]byte{}, namespace...)
+	aad = binary.BigEndian.AppendUint64(aad, gen)
+	aad = binary.BigEndian.AppendUint64(aad, first)
+	return binary.BigEndian.AppendUint64(aad, last)
+}
+
+// archiveLogs archives the entries held in [lo, hi] before DeleteRange
+// removes them, and returns the first index of the log it archived from.
+// Only a range starting at the first entry is archived: raft deletes from
+// the front to compact its log, while a range that leaves the first entry in
+// place is a conflicting suffix that was never committed.
+//
+// It runs before DeleteRange takes the engine's writeMu, so writing and
+// syncing the segment does not hold up the commits of every group: the
+// entries up to the first one are not written again, and DeleteRange
+// archives again under writeMu when the first index moved in between.
+//
+// Entries already archived are skipped up to the first one whose term
+// differs from the archived one: the log was rewritten since, e.g. after a
+// snapshot restore wiped it, and the entries from there on are archived
+// again in a segment superseding the earlier ones.
+func (ps *PebbleStore) archiveLogs(lo, hi uint64) (uint64, error) {
+	a := ps.archive
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	first := ps.firstIndex.Load()
+	if first == 0 || lo > first {
+		return first, nil
+	}
+	if err := ps.writeArchiveSegment(lo, hi); err != nil {
+		return 0, err
+	}
+
+	return first, nil
+}
+
+// writeArchiveSegment writes the segment of [lo, hi]. The caller holds the
+// archiver's mu.
+func (ps *PebbleStore) writeArchiveSegment(lo, hi uint64) error {
+	a := ps.archive
+
+	// The terms archived for the entries of the range already archived
+	var archived []uint64
+	if lo <= a.last {
+		through := min(hi, a.last)
+		archive, err := openLogArchive(a.fs, a.dir, a.namespace, a.cipher)
+		if err != nil {
+			return err
+		}
+		archived = make([]uint64, through-lo+1)
+		err = archive.ForEach(lo, through, func(log *raft.Log) error {
+			archived[log.Index-lo] = log.Term
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	iter, err := ps.db.NewIter(&pebble.IterOptions{
+		LowerBound: ps.buildKey(ps.logsPrefix, uint64ToBytes(lo)),
+		UpperBound: ps.logIterUpperBound(hi),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	w, err := a.newSegmentWriter()
+	if err != nil {
+		return err
+	}
+	defer w.abort()
+
+	log := new(raft.Log)
+	matching := true
+	for iter.First(); iter.Valid(); iter.Next() {
+		index := bytesToUint64(ps.dblogKey(iter.Key()))
+
+		val, err := ps.engine.openLogValue(index, iter.Key(), iter.Value())
+		if err == nil {
+			err = ps.engine.codec.decode(index, val, log)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Entries match up to the first one whose term differs, raft
+		// terms start at 1 so an index missing from the archive differs
+		if matching && index-lo < uint64(len(archived)) && archived[index-lo] == log.Term {
+			continue
+		}
+		matching = false
+
+		if len(w.blocks) == 0 && len(w.buf) == 0 && index <= a.last {
+			w.gen = a.gen + 1
+		}
+		if err := w.add(log); err != nil {
+			return err
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return w.finish()
+}
+
+// segmentWriter writes a segment to temporary files and moves them into
+// place once complete.
+type segmentWriter struct {
+	a    *logArchiver
+	f    vfs.File
+	path string
+
+	offset uint64
+	blocks []archiveBlock
+
+	// gen is above 0 when the segment supersedes archived entries
+	gen uint64
+
+	// The block being filled
+	buf         []byte
+	first, last uint64
+}
+
+func (a *logArchiver) newSegmentWriter() (*segmentWriter, error) {
+	if err := mkdirAllSynced(a.fs, a.dir); err != nil {
+		return nil, err
+	}
+
+	path := a.fs.PathJoin(a.dir, "segment"+archiveSegmentExt+archiveTempExt)
+	f, err := a.fs.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted byte
+	if a.cipher != nil {
+		encrypted = 1
+	}
+
+	header := append(append([]byte{}, archiveSegmentMagic...), archiveVersion, byte(a.compression), encrypted)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		a.fs.Remove(path)
+		return nil, err
+	}
+
+	return &segmentWriter{a: a, f: f, path: path, offset: uint64(len(header))}, nil
+}
+
+func (w *segmentWriter) add(log *raft.Log) error {
+	entry := archiveCodec.encodeBinary(log)
+
+	if len(w.buf) > 0 && len(w.buf)+len(entry) > archiveBlockSize {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	if len(w.buf) == 0 {
+		w.first = log.Index
+	}
+	w.last = log.Index
+
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(entry)))
+	w.buf = append(w.buf, entry...)
+
+	return nil
+}
+
+func (w *segmentWriter) flushBlock() error {
+	payload := compressArchiveBlock(w.a.compression, w.buf)
+
+	if w.a.cipher != nil {
+		sealed, err := w.a.cipher.seal(archiveBlockAAD(w.a.namespace, w.gen, w.first, w.last), payload)
+		if err != nil {
+			return err
+		}
+		payload = sealed
+	}
+
+	frame := make([]byte, archiveFrameHeaderSize, archiveFrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32Castagnoli(payload))
+	frame = append(frame, payload...)
+
+	if _, err := w.f.Write(frame); err != nil {
+		return err
+	}
+
+	w.blocks = append(w.blocks, archiveBlock{
+		first:  w.first,
+		last:   w.last,
+		offset: w.offset,
+		length: uint32(len(payload)),
+		rawLen: uint32(len(w.buf)),
+	})
+	w.offset += uint64(len(frame))
+	w.buf = w.buf[:0]
+
+	return nil
+}
+
+// finish writes the index and moves the segment into place. An empty
+// segment is dropped.
+func (w *segmentWriter) finish() error {
+	if len(w.buf) > 0 {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	if len(w.blocks) == 0 {
+		return nil
+	}
+
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	err := w.f.Close()
+	w.f = nil
+	if err != nil {
+		return err
+	}
+
+	fs, dir := w.a.fs, w.a.dir
+	first, last := w.blocks[0].first, w.blocks[len(w.blocks)-1].last
+	name := archiveSegmentName(first, last, w.gen)
+
+	idx := append([]byte{}, archiveIndexMagic...)
+	idx = append(idx, archiveVersion)
+	for _, b := range w.blocks {
+		idx = binary.BigEndian.AppendUint64(idx, b.first)
+		idx = binary.BigEndian.AppendUint64(idx, b.last)
+		idx = binary.BigEndian.AppendUint64(idx, b.offset)
+		idx = binary.BigEndian.AppendUint32(idx, b.length)
+		idx = binary.BigEndian.AppendUint32(idx, b.rawLen)
+	}
+	idx = binary.BigEndian.AppendUint32(idx, crc32Castagnoli(idx))
+
+	idxTemp := fs.PathJoin(dir, name+archiveIndexExt+archiveTempExt)
+	if err := writeFileSynced(fs, idxTemp, idx); err != nil {
+		fs.Remove(idxTemp)
+		return err
+	}
+
+	if err := fs.Rename(w.path, fs.PathJoin(dir, name+archiveSegmentExt)); err != nil {
+		fs.Remove(idxTemp)
+		return err
+	}
+	w.path = ""
+
+	if err := fs.Rename(idxTemp, fs.PathJoin(dir, name+archiveIndexExt)); err != nil {
+		fs.Remove(idxTemp)
+		return err
+	}
+
+	if err := syncDir(fs, dir); err != nil {
+		return err
+	}
+
+	w.a.last = max(w.a.last, last)
+	w.a.gen = max(w.a.gen, w.gen)
+
+	return nil
+}
+
+// abort removes the temporary segment file unless finish moved it into
+// place.
+func (w *segmentWriter) abort() {
+	if w.f != nil {
+		w.f.Close()
+	}
+	if w.path != "" {
+		w.a.fs.Remove(w.path)
+	}
+}
+
+func writeFileSynced(fs vfs.FS, path string, data []byte) error {
+	f, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func compressArchiveBlock(algo Compression, block []byte) []byte {
+	switch algo {
+	case CompressionSnappy:
+		return snappy.Encode(nil, block)
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(block, nil)
+	}
+	return block
+}
+
+func crc32Castagnoli(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// LogArchive reads the entries a store archived in ArchiveDir. It sees the
+// segments present when it was opened.
+type LogArchive struct {
+	fs        vfs.FS
+	dir       string
+	namespace []byte
+	cipher    *valueCipher
+	segments  []archiveSegment
+	spans     []archiveSpan
+}
+
+// OpenLogArchive opens the archive of a standalone store, in its ArchiveDir
+// dir, for reading. Only FS and, for an encrypted store, KeyProvider are used
+// from cfg; the provider must still know every key that sealed an archived
+// segment. The archive may be read while the store keeps archiving into it.
+func OpenLogArchive(dir string, cfg *PebbleDBConfig) (*LogArchive, error) {
+	return openArchiveWithConfig(cfg, nil, dir)
+}
+
+// OpenGroupLogArchive opens the archive of the group groupID of an engine,
+// in ArchiveDir/group-<id>, for reading. cfg is used as by OpenLogArchive.
+func OpenGroupLogArchive(archiveDir string, groupID uint64, cfg *PebbleDBConfig) (*LogArchive, error) {
+	namespace := append(append([]byte{}, groupPrefix...), uint64ToBytes(groupID)...)
+	return openArchiveWithConfig(cfg, namespace, archiveDir, fmt.Sprintf("group-%d", groupID))
+}
+
+// openArchiveWithConfig opens the archive of the store with namespace in the
+// directory dir joins to.
+func openArchiveWithConfig(cfg *PebbleDBConfig, namespace []byte, dir ...string) (*LogArchive, error) {
+	if cfg == nil {
+		cfg = DefaultPebbleDBConfig()
+	}
+
+	fs := cfg.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+
+	return openLogArchive(fs, fs.PathJoin(dir...), namespace, newValueCipher(cfg.KeyProvider))
+}
+
+func openLogArchive(fs vfs.FS, dir string, namespace []byte, cipher *valueCipher) (*LogArchive, error) {
+	segments, _, err := listArchiveSegments(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogArchive{
+		fs:        fs,
+		dir:       dir,
+		namespace: namespace,
+		cipher:    cipher,
+		segments:  segments,
+		spans:     archiveSpans(segments),
+	}, nil
+}
+
+// LogArchive opens the store's archive for reading.
+func (ps *PebbleStore) LogArchive() (*LogArchive, error) {
+	if !ps.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer ps.release()
+
+	if ps.archive == nil {
+		return nil, ErrNoArchive
+	}
+
+	return openLogArchive(ps.archive.fs, ps.archive.dir, ps.archive.namespace, ps.archive.cipher)
+}
+
+// FirstIndex returns the first index archived. 0 for an empty archive.
+func (a *LogArchive) FirstIndex() uint64 {
+	if len(a.spans) == 0 {
+		return 0
+	}
+	return a.spans[0].first
+}
+
+// LastIndex returns the last index archived. 0 for an empty archive.
+func (a *LogArchive) LastIndex() uint64 {
+	if len(a.spans) == 0 {
+		return 0
+	}
+	return a.spans[len(a.spans)-1].last
+}
+
+// ForEach calls fn with every archived entry in [lo, hi], in index order,
+// and stops at the first error fn returns. Only the blocks holding the range
+// are read, and each is verified against its checksum before it is decoded.
+// An index archived more than once is read from the latest segment holding
+// it. The log passed to fn is reused between calls.
+func (a *LogArchive) ForEach(lo, hi uint64, fn func(log *raft.Log) error) error {
+	log := new(raft.Log)
+
+	for _, span := range a.spans {
+		if span.last < lo || span.first > hi {
+			continue
+		}
+
+		seg := span.seg
+		err := a.forEachInSegment(seg, max(lo, span.first), min(hi, span.last), func(index uint64, entry []byte) error {
+			if err := archiveCodec.decodeBinary(entry, log); err != nil {
+				return a.corrupt(seg, "index %d: %v", index, err)
+			}
+			if log.Index != index {
+				return a.corrupt(seg, "index %d: entry holds index %d", index, log.Index)
+			}
+			return fn(log)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forEachInSegment calls fn with the encoded entries of seg in [lo, hi].
+func (a *LogArchive) forEachInSegment(seg archiveSegment, lo, hi uint64, fn func(index uint64, entry []byte) error) error {
+	blocks, err := a.readArchiveIndex(seg)
+	if err != nil {
+		return err
+	}
+
+	f, err := a.fs.Open(a.fs.PathJoin(a.dir, seg.name+archiveSegmentExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, archiveSegmentHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return a.corrupt(seg, "short header: %v", err)
+	}
+	if !bytes.Equal(header[:4], archiveSegmentMagic) || header[4] != archiveVersion {
+		return a.corrupt(seg, "bad header")
+	}
+	compression, encrypted := Compression(header[5]), header[6] == 1
+	if compression > CompressionZstd {
+		return a.corrupt(seg, "unknown compression %d", header[5])
+	}
+	if encrypted && a.cipher == nil {
+		return ErrNoKeyProvider
+	}
+
+	for _, b := range blocks {
+		if b.last < lo || b.first > hi {
+			continue
+		}
+
+		block, err := a.readArchiveBlock(seg, f, b, compression, encrypted)
+		if err != nil {
+			return err
+		}
+
+		next := b.first
+		for len(block) > 0 {
+			n, size := binary.Uvarint(block)
+			if size <= 0 || n > uint64(len(block)-size) {
+				return a.corrupt(seg, "truncated block at offset %d", b.offset)
+			}
+			entry := block[size : size+int(n)]
+			block = block[size+int(n):]
+
+			// Entries are in increasing order, their index is right after
+			// the format, flags and index of the binary codec
+			if len(entry) < 3 {
+				return a.corrupt(seg, "short entry in block at offset %d", b.offset)
+			}
+			index, isize := binary.Uvarint(entry[2:])
+			if isize <= 0 || index < next || index > b.last {
+				return a.corrupt(seg, "out of order entry in block at offset %d", b.offset)
+			}
+			next = index + 1
+
+			if index < lo {
+				continue
+			}
+			if index > hi {
+				return nil
+			}
+			if err := fn(index, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *LogArchive) readArchiveIndex(seg archiveSegment) ([]archiveBlock, error) {
+	f, err := a.fs.Open(a.fs.PathJoin(a.dir, seg.name+archiveIndexExt))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	header := len(archiveIndexMagic) + 1
+	if len(buf) < header+4 || (len(buf)-header-4)%archiveRecordSize != 0 {
+		return nil, a.corrupt(seg, "index has size %d", len(buf))
+	}
+	body := buf[:len(buf)-4]
+	if binary.BigEndian.Uint32(buf[len(body):]) != crc32Castagnoli(body) {
+		return nil, a.corrupt(seg, "index %s", errChecksumMismatch)
+	}
+	if !bytes.Equal(body[:4], archiveIndexMagic) || body[4] != archiveVersion {
+		return nil, a.corrupt(seg, "bad index header")
+	}
+
+	var blocks []archiveBlock
+	for rec := body[header:]; len(rec) > 0; rec = rec[archiveRecordSize:] {
+		blocks = append(blocks, archiveBlock{
+			first:  binary.BigEndian.Uint64(rec),
+			last:   binary.BigEndian.Uint64(rec[8:]),
+			offset: binary.BigEndian.Uint64(rec[16:]),
+			length: binary.BigEndian.Uint32(rec[24:]),
+			rawLen: binary.BigEndian.Uint32(rec[28:]),
+		})
+	}
+
+	// The blocks cover the segment's range in order
+	next := seg.first
+	for i, b := range blocks {
+		if b.first < next || b.first > b.last || (i == 0 && b.first != seg.first) {
+			return nil, a.corrupt(seg, "index out of order")
+		}
+		next = b.last + 1
+	}
+	if len(blocks) == 0 || blocks[len(blocks)-1].last != seg.last {
+		return nil, a.corrupt(seg, "index does not cover %d-%d", seg.first, seg.last)
+	}
+
+	return blocks, nil
+}
+
+// readArchiveBlock reads, verifies and opens the block b of seg.
+func (a *LogArchive) readArchiveBlock(seg archiveSegment, f vfs.File, b archiveBlock, compression Compression, encrypted bool) ([]byte, error) {
+	frame := make([]byte, archiveFrameHeaderSize+int(b.length))
+	if _, err := f.ReadAt(frame, int64(b.offset)); err != nil {
+		return nil, a.corrupt(seg, "block at offset %d: %v", b.offset, err)
+	}
+	if binary.BigEndian.Uint32(frame) != b.length {
+		return nil, a.corrupt(seg, "block at offset %d has the wrong size", b.offset)
+	}
+
+	payload := frame[archiveFrameHeaderSize:]
+	if binary.BigEndian.Uint32(frame[4:]) != crc32Castagnoli(payload) {
+		return nil, a.corrupt(seg, "block at offset %d: %s", b.offset, errChecksumMismatch)
+	}
+
+	if encrypted {
+		plain, _, err := a.cipher.open(archiveBlockAAD(a.namespace, seg.gen, b.first, b.last), payload)
+		if err != nil {
+			return nil, a.corrupt(seg, "block at offset %d: %v", b.offset, err)
+		}
+		payload = plain
+	}
+
+	if compression == CompressionNone {
+		if len(payload) != int(b.rawLen) {
+			return nil, a.corrupt(seg, "block at offset %d: %s", b.offset, errDecompressedSize)
+		}
+		return payload, nil
+	}
+
+	block, err := archiveCodec.decompress(compression, payload, uint64(b.rawLen))
+	if err != nil {
+		return nil, a.corrupt(seg, "block at offset %d: %v", b.offset, err)
+	}
+
+	return block, nil
+}
+
+func (a *LogArchive) corrupt(seg archiveSegment, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: segment %s: %s", ErrCorruptArchive, seg.name, fmt.Sprintf(format, args...))
+}
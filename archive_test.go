@@ -0,0 +1,456 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// testArchiveData is the payload of every log the archive tests store.
+var testArchiveData = []byte(strings.Repeat("command ", 20))
+
+// testCheckArchive reads [lo, hi] back from archive and compares it with what
+// was stored at term.
+func testCheckArchive(t *testing.T, archive *LogArchive, lo, hi, term uint64) {
+	t.Helper()
+
+	wants := testLogRange(lo, hi, term, testArchiveData)
+
+	next := lo
+	err := archive.ForEach(lo, hi, func(log *raft.Log) error {
+		if next > hi {
+			return fmt.Errorf("read %d past %d", log.Index, hi)
+		}
+		if want := wants[next-lo]; !reflect.DeepEqual(log, want) {
+			return fmt.Errorf("bad: %#v, expected %#v", log, want)
+		}
+		next++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if next != hi+1 {
+		t.Fatalf("read up to %d, expected %d", next-1, hi)
+	}
+}
+
+func TestPebbleStore_Archive(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+		t.Run(compression.String(), func(t *testing.T) {
+			cfg := DefaultPebbleDBConfig()
+			cfg.ArchiveDir = t.TempDir()
+			cfg.ArchiveCompression = compression
+			cfg.LogCompression = CompressionSnappy
+
+			store := testPebbleStoreWithConfig(t, cfg)
+			defer os.RemoveAll(store.path)
+			defer store.Close()
+
+			testStoreLogRange(t, store, 1, 1000, 1, testArchiveData)
+
+			// Several blocks in one segment
+			if err := store.DeleteRange(1, 500); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := store.DeleteRange(501, 600); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			// A conflicting suffix is not archived
+			if err := store.DeleteRange(900, 1000); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			archive, err := store.LogArchive()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if archive.FirstIndex() != 1 || archive.LastIndex() != 600 {
+				t.Fatalf("bad: %d-%d", archive.FirstIndex(), archive.LastIndex())
+			}
+
+			testCheckArchive(t, archive, 1, 600, 1)
+			testCheckArchive(t, archive, 250, 260, 1)
+			testCheckArchive(t, archive, 450, 550, 1)
+			testCheckArchive(t, archive, 600, 600, 1)
+
+			// Out of range reads nothing
+			err = archive.ForEach(601, 1000, func(log *raft.Log) error {
+				return fmt.Errorf("unexpected %d", log.Index)
+			})
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			// fn's error stops the iteration
+			stop := errors.New("stop")
+			if err := archive.ForEach(1, 600, func(*raft.Log) error { return stop }); err != stop {
+				t.Fatalf("expected stop, got: %v", err)
+			}
+
+			names, _ := os.ReadDir(cfg.ArchiveDir)
+			if len(names) != 4 {
+				t.Fatalf("bad: %v", names)
+			}
+		})
+	}
+}
+
+func TestPebbleStore_ArchiveResume(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.ArchiveDir = t.TempDir()
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	testStoreLogRange(t, store, 1, 300, 1, testArchiveData)
+
+	// A crash after archiving and before the delete
+	if _, err := store.archiveLogs(1, 100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Leftovers of an interrupted segment
+	orphan := filepath.Join(cfg.ArchiveDir, archiveSegmentName(101, 150, 0)+archiveSegmentExt)
+	temp := filepath.Join(cfg.ArchiveDir, "segment"+archiveSegmentExt+archiveTempExt)
+	for _, path := range []string{orphan, temp} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	store.Close()
+	store, err := NewPebbleStore(store.path, &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	for _, path := range []string{orphan, temp} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("not removed: %s", path)
+		}
+	}
+
+	if err := store.DeleteRange(1, 200); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	archive, err := store.LogArchive()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(archive.segments) != 2 || archive.segments[1].first != 101 {
+		t.Fatalf("bad: %v", archive.segments)
+	}
+	testCheckArchive(t, archive, 1, 200, 1)
+}
+
+func TestPebbleStore_ArchiveRewritten(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.ArchiveDir = t.TempDir()
+	cfg.Monotonic = true
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	// A snapshot restore wipes the log, which is then rewritten at a later
+	// term over indexes already archived
+	testStoreLogRange(t, store, 1, 10, 1, testArchiveData)
+	if err := store.DeleteRange(1, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testStoreLogRange(t, store, 6, 12, 2, testArchiveData)
+	if err := store.DeleteRange(6, 12); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	archive, err := store.LogArchive()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if archive.FirstIndex() != 1 || archive.LastIndex() != 12 {
+		t.Fatalf("bad: %d-%d", archive.FirstIndex(), archive.LastIndex())
+	}
+	testCheckArchive(t, archive, 1, 5, 1)
+	testCheckArchive(t, archive, 6, 12, 2)
+
+	// Rewritten below the end of the archive, only the entries whose term
+	// changed are archived again
+	testStoreLogRange(t, store, 4, 5, 1, testArchiveData)
+	testStoreLogRange(t, store, 6, 8, 2, testArchiveData)
+	testStoreLogRange(t, store, 9, 10, 3, testArchiveData)
+	if err := store.DeleteRange(4, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	store.Close()
+	store, err = NewPebbleStore(store.path, &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	archive, err = store.LogArchive()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(archive.segments) != 3 || archive.segments[2].name != archiveSegmentName(9, 10, 2) {
+		t.Fatalf("bad: %v", archive.segments)
+	}
+	testCheckArchive(t, archive, 1, 5, 1)
+	testCheckArchive(t, archive, 6, 8, 2)
+	testCheckArchive(t, archive, 9, 10, 3)
+	testCheckArchive(t, archive, 11, 12, 2)
+
+	// The gen survives the reopen: a later rewrite still supersedes
+	testStoreLogRange(t, store, 12, 12, 4, testArchiveData)
+	if err := store.DeleteRange(12, 12); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	archive, err = store.LogArchive()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testCheckArchive(t, archive, 11, 11, 2)
+	testCheckArchive(t, archive, 12, 12, 4)
+}
+
+func TestPebbleStore_ArchiveCorrupt(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.ArchiveDir = t.TempDir()
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	testStoreLogRange(t, store, 1, 100, 1, testArchiveData)
+	if err := store.DeleteRange(1, 100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	name := filepath.Join(cfg.ArchiveDir, archiveSegmentName(1, 100, 0))
+	for _, ext := range []string{archiveSegmentExt, archiveIndexExt} {
+		buf, err := os.ReadFile(name + ext)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		damaged := append([]byte{}, buf...)
+		damaged[len(damaged)-5] ^= 0xff
+		if err := os.WriteFile(name+ext, damaged, 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		archive, err := OpenLogArchive(cfg.ArchiveDir, cfg)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		err = archive.ForEach(1, 100, func(*raft.Log) error { return nil })
+		if !errors.Is(err, ErrCorruptArchive) {
+			t.Fatalf("%s: expected corrupt archive, got: %v", ext, err)
+		}
+
+		if err := os.WriteFile(name+ext, buf, 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestPebbleStore_ArchiveEncrypted(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.ArchiveDir = t.TempDir()
+	cfg.KeyProvider = testKeyProvider(t, "a "+testKeyA)
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	testStoreLogRange(t, store, 1, 100, 1, testArchiveData)
+	if err := store.DeleteRange(1, 100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	buf, err := os.ReadFile(filepath.Join(cfg.ArchiveDir, archiveSegmentName(1, 100, 0)+archiveSegmentExt))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if bytes.Contains(buf, []byte("command")) {
+		t.Fatalf("archive holds plaintext")
+	}
+
+	plain := DefaultPebbleDBConfig()
+	archive, err := OpenLogArchive(cfg.ArchiveDir, plain)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := archive.ForEach(1, 100, func(*raft.Log) error { return nil }); !errors.Is(err, ErrNoKeyProvider) {
+		t.Fatalf("expected no key provider, got: %v", err)
+	}
+
+	archive, err = OpenLogArchive(cfg.ArchiveDir, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testCheckArchive(t, archive, 1, 100, 1)
+}
+
+func TestPebbleEngine_ArchiveGroups(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.ArchiveDir = t.TempDir()
+
+	engine, err := NewPebbleEngine(t.TempDir(), &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer engine.Close()
+
+	for group := uint64(1); group <= 2; group++ {
+		store, err := engine.Store(group)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		testStoreLogRange(t, store, 1, 10*group, 1, testArchiveData)
+		if err := store.DeleteRange(1, 10*group); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	for group := uint64(1); group <= 2; group++ {
+		archive, err := OpenGroupLogArchive(cfg.ArchiveDir, group, cfg)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if archive.LastIndex() != 10*group {
+			t.Fatalf("bad: %d", archive.LastIndex())
+		}
+		testCheckArchive(t, archive, 1, 10*group, 1)
+	}
+}
+
+func TestPebbleEngine_ArchiveSwapped(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.ArchiveDir = t.TempDir()
+	cfg.KeyProvider = testKeyProvider(t, "a "+testKeyA)
+
+	engine, err := NewPebbleEngine(t.TempDir(), &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer engine.Close()
+
+	for group := uint64(1); group <= 2; group++ {
+		store, err := engine.Store(group)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		testStoreLogRange(t, store, 1, 10, group, testArchiveData)
+		if err := store.DeleteRange(1, 10); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	name := archiveSegmentName(1, 10, 0)
+	dir1 := filepath.Join(cfg.ArchiveDir, "group-1")
+	dir2 := filepath.Join(cfg.ArchiveDir, "group-2")
+
+	// A segment moved from another group, sealed with the same key
+	for _, ext := range []string{archiveSegmentExt, archiveIndexExt} {
+		buf, err := os.ReadFile(filepath.Join(dir1, name+ext))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir2, name+ext), buf, 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	archive, err := OpenGroupLogArchive(cfg.ArchiveDir, 2, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := archive.ForEach(1, 10, func(*raft.Log) error { return nil }); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("expected corrupt archive, got: %v", err)
+	}
+
+	// A segment passed off as superseding itself
+	for _, ext := range []string{archiveSegmentExt, archiveIndexExt} {
+		if err := os.Rename(filepath.Join(dir1, name+ext), filepath.Join(dir1, archiveSegmentName(1, 10, 1)+ext)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	archive, err = OpenGroupLogArchive(cfg.ArchiveDir, 1, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := archive.ForEach(1, 10, func(*raft.Log) error { return nil }); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("expected corrupt archive, got: %v", err)
+	}
+}
+
+func TestPebbleEngine_ArchiveOutsideWriteLock(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.ArchiveDir = t.TempDir()
+
+	engine, err := NewPebbleEngine(t.TempDir(), &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer engine.Close()
+
+	archiving, err := engine.Store(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	other, err := engine.Store(2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testStoreLogRange(t, archiving, 1, 100, 1, testArchiveData)
+
+	// Hold up the segment being written
+	archiving.archive.mu.Lock()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- archiving.DeleteRange(1, 100)
+	}()
+
+	// The other group keeps committing meanwhile
+	testStoreLogRange(t, other, 1, 10, 1, testArchiveData)
+	select {
+	case err := <-errc:
+		t.Fatalf("delete did not wait for the archive: %v", err)
+	default:
+	}
+
+	archiving.archive.mu.Unlock()
+	if err := <-errc; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	archive, err := archiving.LogArchive()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testCheckArchive(t, archive, 1, 100, 1)
+}
+
+func TestPebbleStore_NoArchive(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	if _, err := store.LogArchive(); !errors.Is(err, ErrNoArchive) {
+		t.Fatalf("expected no archive, got: %v", err)
+	}
+}
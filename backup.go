@@ -0,0 +1,340 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+)
+
+// ErrInvalidBackup is matched by errors.Is for every error VerifyBackup and
+// RestoreBackup return about the content of a backup.
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// Backup writes a consistent copy of the engine's db to dir while it keeps
+// serving reads and writes. dir must not exist. The copy is a pebble
+// checkpoint: sstables are hard linked when dir is on the same filesystem,
+// and the WAL is synced first so every write acknowledged before Backup is
+// included. dir gets the same data and wal layout as the engine's path, so
+// it opens with NewPebbleEngine or NewPebbleStore like any store. Every group
+// of the engine is included. A read-only engine is backed up too, which lets
+// a sidecar take backups of a stopped node.
+func (e *PebbleEngine) Backup(dir string) error {
+	if !e.ops.acquire() {
+		return pebble.ErrClosed
+	}
+	defer e.ops.release()
+
+	if _, err := e.fs.Stat(dir); err == nil {
+		return &os.PathError{Op: "backup", Path: dir, Err: os.ErrExist}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	backup := e.backup
+	if e.readOnly {
+		backup = e.backupReadOnly
+	}
+
+	if err := backup(dir); err != nil {
+		e.fs.RemoveAll(dir)
+		return err
+	}
+
+	return nil
+}
+
+func (e *PebbleEngine) backup(dir string) error {
+	if err := mkdirAllSynced(e.fs, dir); err != nil {
+		return err
+	}
+
+	dataPath := e.fs.PathJoin(dir, "data")
+	if err := e.db.Checkpoint(dataPath, pebble.WithFlushedWAL()); err != nil {
+		return err
+	}
+
+	// The checkpoint puts the WAL next to the sstables, while a store keeps
+	// it in its own directory and only replays the logs found there
+	walPath := e.fs.PathJoin(dir, "wal")
+	if err := e.fs.MkdirAll(walPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	names, err := e.fs.List(dataPath)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		if err := e.fs.Rename(e.fs.PathJoin(dataPath, name), e.fs.PathJoin(walPath, name)); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range []string{walPath, dataPath, dir} {
+		if err := syncDir(e.fs, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backupReadOnly copies the files of a read-only engine. pebble does not
+// checkpoint a db opened read-only, as it has no OPTIONS file of its own, but
+// the open db keeps the directory locked so no other process changes the
+// files while they are copied. sstables never change and are hard linked
+// when possible, the other files are copied and synced.
+func (e *PebbleEngine) backupReadOnly(dir string) error {
+	fs := vfs.NewSyncingFS(e.fs, vfs.SyncingFileOptions{})
+
+	if err := mkdirAllSynced(fs, dir); err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"data", "wal"} {
+		src, dst := fs.PathJoin(e.path, sub), fs.PathJoin(dir, sub)
+		if err := fs.MkdirAll(dst, os.ModePerm); err != nil {
+			return err
+		}
+
+		names, err := fs.List(src)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if name == "LOCK" {
+				continue
+			}
+
+			srcPath, dstPath := fs.PathJoin(src, name), fs.PathJoin(dst, name)
+			if info, err := fs.Stat(srcPath); err != nil {
+				return err
+			} else if info.IsDir() {
+				continue
+			}
+
+			if strings.HasSuffix(name, ".sst") {
+				err = vfs.LinkOrCopy(fs, srcPath, dstPath)
+			} else {
+				err = vfs.Copy(fs, srcPath, dstPath)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := syncDir(fs, dst); err != nil {
+			return err
+		}
+	}
+
+	return syncDir(fs, dir)
+}
+
+// Backup writes a consistent copy of the store's engine to dir, see
+// PebbleEngine.Backup. For a group view, the copy holds every group of the
+// engine.
+func (ps *PebbleStore) Backup(dir string) error {
+	if !ps.acquire() {
+		return pebble.ErrClosed
+	}
+	defer ps.release()
+
+	return ps.engine.Backup(dir)
+}
+
+// VerifyBackup opens the backup at dir read-only and decodes every log entry
+// and stable value of its standalone store and of every group, so checksums
+// and encryption are checked. cfg must hold the KeyProvider of an encrypted
+// store. The backup is not modified.
+func VerifyBackup(dir string, logger pebble.Logger, cfg *PebbleDBConfig) error {
+	if cfg == nil {
+		cfg = DefaultPebbleDBConfig()
+	}
+
+	ro := *cfg
+	ro.ReadOnly = true
+
+	engine, err := NewPebbleEngine(dir, logger, &ro)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+	defer engine.Close()
+
+	ps, err := newPebbleStore(engine, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+	if err := verifyStore(ps); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+
+	groups, err := engine.Groups()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+
+	for _, group := range groups {
+		ps, err := engine.Store(group)
+		if err == nil {
+			err = verifyStore(ps)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: group %d: %w", ErrInvalidBackup, group, err)
+		}
+	}
+
+	return nil
+}
+
+// verifyStore decodes every log entry and stable value of ps.
+func verifyStore(ps *PebbleStore) error {
+	iter, err := ps.db.NewIter(ps.logIterOptions())
+	if err != nil {
+		return err
+	}
+
+	var log raft.Log
+	for iter.First(); iter.Valid(); iter.Next() {
+		index := bytesToUint64(ps.dblogKey(iter.Key()))
+
+		val, err := ps.engine.openLogValue(index, iter.Key(), iter.Value())
+		if err == nil {
+			err = ps.engine.codec.decode(index, val, &log)
+		}
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if err := ps.ForEach(func([]byte, []byte) error { return nil }); err != nil {
+		return err
+	}
+
+	return ps.ForEachUint64(func([]byte, uint64) error { return nil })
+}
+
+// RestoreBackup replaces the store at path with a copy of the backup at
+// backupDir. The backup is verified with VerifyBackup before anything is
+// touched, then copied next to path and swapped in with renames, so path
+// never holds a partial copy. The old store is moved to path + ".old" and
+// deleted once the swap is done; after a crash in between, the next
+// RestoreBackup moves it back first. path must not be open. The backup
+// is left in place and can be restored again.
+func RestoreBackup(backupDir, path string, logger pebble.Logger, cfg *PebbleDBConfig) error {
+	if cfg == nil {
+		cfg = DefaultPebbleDBConfig()
+	}
+
+	if err := VerifyBackup(backupDir, logger, cfg); err != nil {
+		return err
+	}
+
+	fs := cfg.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+
+	staging := path + ".restore"
+	old := path + ".old"
+
+	// Left over by an interrupted restore. If it stopped between the two
+	// renames, old is the only copy of the store
+	if err := fs.RemoveAll(staging); err != nil {
+		return err
+	}
+	if _, err := fs.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if _, err := fs.Stat(old); err == nil {
+			if err := fs.Rename(old, path); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fs.RemoveAll(old); err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"data", "wal"} {
+		if err := copyDir(fs, fs.PathJoin(backupDir, sub), fs.PathJoin(staging, sub)); err != nil {
+			fs.RemoveAll(staging)
+			return err
+		}
+	}
+	if err := syncDir(fs, staging); err != nil {
+		fs.RemoveAll(staging)
+		return err
+	}
+
+	if _, err := fs.Stat(path); err == nil {
+		if err := fs.Rename(path, old); err != nil {
+			fs.RemoveAll(staging)
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		fs.RemoveAll(staging)
+		return err
+	}
+
+	if err := fs.Rename(staging, path); err != nil {
+		fs.Rename(old, path)
+		fs.RemoveAll(staging)
+		return err
+	}
+
+	if err := syncDir(fs, fs.PathDir(path)); err != nil {
+		return err
+	}
+
+	return fs.RemoveAll(old)
+}
+
+// copyDir copies the files of src into dst, which is created, and syncs them.
+// Files are copied rather than linked: pebble reuses WAL files by writing
+// over them, which would change the backup through a link.
+func copyDir(fs vfs.FS, src, dst string) error {
+	names, err := fs.List(src)
+	if err != nil {
+		return err
+	}
+
+	if err := mkdirAllSynced(fs, dst); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		// The lock of whoever opened the backup last
+		if name == "LOCK" {
+			continue
+		}
+		if err := vfs.Copy(fs, fs.PathJoin(src, name), fs.PathJoin(dst, name)); err != nil {
+			return err
+		}
+	}
+
+	return syncDir(fs, dst)
+}
+
+func syncDir(fs vfs.FS, dir string) error {
+	d, err := fs.OpenDir(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
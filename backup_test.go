@@ -0,0 +1,235 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestPebbleStore_Backup(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64([]byte("CurrentTerm"), 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "backup")
+	if err := store.Backup(dir); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Backup(dir); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected exist error, got: %v", err)
+	}
+
+	// Not part of the backup
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(3, "log3")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := VerifyBackup(dir, &Logger{}, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	backup, err := NewPebbleStore(dir, &Logger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer backup.Close()
+
+	if last, _ := backup.LastIndex(); last != 2 {
+		t.Fatalf("bad: %d", last)
+	}
+	log := new(raft.Log)
+	if err := backup.GetLog(2, log); err != nil || string(log.Data) != "log2" {
+		t.Fatalf("bad: %q %v", log.Data, err)
+	}
+	if term, err := backup.GetUint64([]byte("CurrentTerm")); err != nil || term != 3 {
+		t.Fatalf("bad: %d %v", term, err)
+	}
+
+	// The backup is a working store
+	if err := backup.StoreLogs([]*raft.Log{testRaftLog(3, "other")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestPebbleEngine_Backup(t *testing.T) {
+	engine, err := NewPebbleEngine(t.TempDir(), &Logger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer engine.Close()
+
+	for _, group := range []uint64{1, 2} {
+		store, err := engine.Store(group)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := store.StoreLogs([]*raft.Log{testRaftLog(group, "log")}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "backup")
+	if err := engine.Backup(dir); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	backup, err := NewPebbleEngine(dir, &Logger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer backup.Close()
+
+	for _, group := range []uint64{1, 2} {
+		store, err := backup.Store(group)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if last, _ := store.LastIndex(); last != group {
+			t.Fatalf("bad: %d", last)
+		}
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "store")
+
+	store, err := NewPebbleStore(path, &Logger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir := filepath.Join(root, "backup")
+	if err := store.Backup(dir); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	if err := RestoreBackup(dir, path, &Logger{}, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, leftover := range []string{path + ".restore", path + ".old"} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Fatalf("%s left behind: %v", leftover, err)
+		}
+	}
+
+	store, err = NewPebbleStore(path, &Logger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last, _ := store.LastIndex(); last != 1 {
+		t.Fatalf("bad: %d", last)
+	}
+	store.Close()
+
+	// The backup can be restored again
+	if err := VerifyBackup(dir, &Logger{}, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A broken backup leaves the store alone
+	if err := os.Remove(filepath.Join(dir, "data", "CURRENT")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := RestoreBackup(dir, path, &Logger{}, nil); !errors.Is(err, ErrInvalidBackup) {
+		t.Fatalf("expected invalid backup, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "data", "CURRENT")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestVerifyBackup_Encrypted(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.KeyProvider = testKeyProvider(t, "a "+testKeyA)
+
+	store, err := NewPebbleStore(t.TempDir(), &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "backup")
+	if err := store.Backup(dir); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := VerifyBackup(dir, &Logger{}, cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := VerifyBackup(dir, &Logger{}, nil); !errors.Is(err, ErrInvalidBackup) {
+		t.Fatalf("expected invalid backup, got: %v", err)
+	}
+}
+
+func TestPebbleStore_BackupReadOnly(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64([]byte("CurrentTerm"), 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	ro, err := NewPebbleStoreReadOnly(store.path, &Logger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer ro.Close()
+
+	dir := filepath.Join(t.TempDir(), "backup")
+	if err := ro.Backup(dir); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ro.Backup(dir); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected exist error, got: %v", err)
+	}
+	if err := VerifyBackup(dir, &Logger{}, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	backup, err := NewPebbleStore(dir, &Logger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer backup.Close()
+
+	if last, _ := backup.LastIndex(); last != 2 {
+		t.Fatalf("bad: %d", last)
+	}
+	if term, err := backup.GetUint64([]byte("CurrentTerm")); err != nil || term != 3 {
+		t.Fatalf("bad: %d %v", term, err)
+	}
+
+	// The backup is a working store, and the source is left alone
+	if err := backup.StoreLogs([]*raft.Log{testRaftLog(3, "log3")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last, _ := ro.LastIndex(); last != 2 {
+		t.Fatalf("bad: %d", last)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
 	raftbench "github.com/hashicorp/raft/bench"
 )
 
@@ -277,6 +278,50 @@ func Benchmark_PebbleNoSync_Batch(b *testing.B) {
 	}
 }
 
+func benchmarkStoreGetLogs(b *testing.B) *PebbleStore {
+	store := testPebbleStore(b)
+
+	logs := make([]*raft.Log, 0, 1000)
+	for i := uint64(1); i <= 1000; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: randomBytes(256)})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		b.Fatalf("err: %s", err)
+	}
+
+	return store
+}
+
+func BenchmarkPebbleStore_GetLogs(b *testing.B) {
+	store := benchmarkStoreGetLogs(b)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		logs, err := store.GetLogs(1, 64, 0)
+		if err != nil || len(logs) != 64 {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkPebbleStore_GetLogLoop(b *testing.B) {
+	store := benchmarkStoreGetLogs(b)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		logs := make([]raft.Log, 64)
+		for i := range logs {
+			if err := store.GetLog(uint64(i+1), &logs[i]); err != nil {
+				b.Fatalf("err: %s", err)
+			}
+		}
+	}
+}
+
 var idChars = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
 
 func randomId(idLen int) []byte {
@@ -0,0 +1,248 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+	"go.uber.org/atomic"
+)
+
+// TestPebbleStore_CloseWhileBusy calls every method from many goroutines
+// while the store is closed under them. Run with -race.
+func TestPebbleStore_CloseWhileBusy(t *testing.T) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		cfg := DefaultPebbleDBConfig()
+		cfg.GroupCommitWindow = window
+		cfg.Durability = SyncNever
+
+		store := testPebbleStoreWithConfig(t, cfg)
+		defer os.RemoveAll(store.path)
+
+		if err := store.SetUint64([]byte("CurrentTerm"), 1); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		snaps, err := NewPebbleSnapshotStore(store, 100)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		ops := map[string]func(i uint64) error{
+			"StoreLogs": func(i uint64) error {
+				return store.StoreLogs([]*raft.Log{testRaftLog(i, "log"), testRaftLog(i+1, "log")})
+			},
+			"GetLog": func(i uint64) error {
+				return store.GetLog(i, new(raft.Log))
+			},
+			"GetLogs": func(i uint64) error {
+				_, err := store.GetLogs(i, i+10, 0)
+				return err
+			},
+			"DeleteRange": func(i uint64) error {
+				return store.DeleteRange(i/2, i/2+1)
+			},
+			"Indexes": func(i uint64) error {
+				if _, err := store.FirstIndex(); err != nil {
+					return err
+				}
+				_, err := store.LastIndex()
+				return err
+			},
+			"Set": func(i uint64) error {
+				if err := store.Set([]byte("k"), []byte("v")); err != nil {
+					return err
+				}
+				_, err := store.Get([]byte("k"))
+				return err
+			},
+			"SetUint64": func(i uint64) error {
+				if err := store.SetUint64([]byte("CurrentTerm"), i); err != nil {
+					return err
+				}
+				_, err := store.GetUint64([]byte("CurrentTerm"))
+				return err
+			},
+			"ForEach": func(i uint64) error {
+				return store.ForEach(func([]byte, []byte) error { return nil })
+			},
+			"Sync": func(i uint64) error {
+				return store.Sync()
+			},
+			"Metrics": func(i uint64) error {
+				_, err := store.Engine().Metrics()
+				return err
+			},
+			"Snapshot": func(i uint64) error {
+				_, trans := raft.NewInmemTransport("")
+				sink, err := snaps.Create(raft.SnapshotVersionMax, i, 1, raft.Configuration{}, 1, trans)
+				if err != nil {
+					return err
+				}
+				if _, err := sink.Write([]byte("state")); err != nil {
+					sink.Cancel()
+					return err
+				}
+				if err := sink.Close(); err != nil {
+					return err
+				}
+
+				_, r, err := snaps.Open(sink.ID())
+				if err != nil {
+					return err
+				}
+				_, err = io.ReadAll(r)
+				r.Close()
+				return err
+			},
+		}
+
+		var wg sync.WaitGroup
+		errc := make(chan error, len(ops))
+		for name, op := range ops {
+			wg.Add(1)
+			go func(name string, op func(uint64) error) {
+				defer wg.Done()
+				for i := uint64(1); ; i++ {
+					err := op(i)
+					if errors.Is(err, pebble.ErrClosed) {
+						return
+					}
+					if err != nil && !errors.Is(err, raft.ErrLogNotFound) {
+						errc <- errors.New(name + ": " + err.Error())
+						return
+					}
+				}
+			}(name, op)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+
+		// Concurrent closes all succeed
+		var closers sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			closers.Add(1)
+			go func() {
+				defer closers.Done()
+				if err := store.Close(); err != nil {
+					errc <- err
+				}
+			}()
+		}
+		closers.Wait()
+		wg.Wait()
+
+		close(errc)
+		for err := range errc {
+			t.Fatalf("window %s: %s", window, err)
+		}
+
+		if err := store.Close(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestPebbleStore_CloseTimeout(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.CloseTimeout = 20 * time.Millisecond
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+
+	snaps, err := NewPebbleSnapshotStore(store, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	id := testCreateSnapshot(t, snaps, 1, []byte("state"))
+
+	_, r, err := snaps.Open(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The open reader keeps the store busy
+	if err := store.Close(); !errors.Is(err, ErrCloseTimeout) {
+		t.Fatalf("expected close timeout, got: %v", err)
+	}
+	if err := store.StoreLog(testRaftLog(1, "log")); !errors.Is(err, pebble.ErrClosed) {
+		t.Fatalf("expected closed, got: %v", err)
+	}
+	if body, err := io.ReadAll(r); err != nil || string(body) != "state" {
+		t.Fatalf("bad: %q %v", body, err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+// TestOpTracker_Drain checks that no operation is running once drain returns,
+// however acquire and release interleave with it. Run with -race.
+func TestOpTracker_Drain(t *testing.T) {
+	for round := 0; round < 100; round++ {
+		ops := newOpTracker()
+		running := atomic.NewInt64(0)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ops.acquire() {
+					running.Inc()
+					running.Dec()
+					ops.release()
+				}
+			}()
+		}
+
+		if err := ops.drain(0); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if n := running.Load(); n != 0 {
+			t.Fatalf("bad: %d running after drain", n)
+		}
+		if ops.acquire() {
+			t.Fatalf("acquired after drain")
+		}
+		wg.Wait()
+	}
+}
+
+func TestPebbleFSM_CloseWhileApplying(t *testing.T) {
+	fsm := testPebbleFSM(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := uint64(1); ; i++ {
+				resp := fsm.Apply(&raft.Log{Index: i, Type: raft.LogCommand, Data: []byte("k=v")})
+				if err, ok := resp.(error); ok {
+					if !errors.Is(err, pebble.ErrClosed) {
+						t.Errorf("err: %s", err)
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := fsm.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	wg.Wait()
+}
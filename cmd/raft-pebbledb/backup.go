@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	raftpebbledb "github.com/xkeyideal/raft-pebbledb"
+)
+
+func runBackup(args []string, stdout io.Writer) error {
+	var sf storeFlags
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	sf.register(fs)
+	out := fs.String("out", "", "directory to write the backup to; must not exist")
+
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("%w: backup needs -out", errUsage)
+	}
+
+	// Opening a missing store would create it
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+
+	// The whole engine is copied, whatever the group
+	engine, err := sf.openEngine(dir, false)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	if err := engine.Backup(*out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "backed up %s to %s\n", dir, *out)
+
+	return nil
+}
+
+func runRestore(args []string, stdout io.Writer) error {
+	var sf storeFlags
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	sf.register(fs)
+	from := fs.String("from", "", "backup directory to restore")
+	verify := fs.Bool("verify", false, "only verify the backup given by -from, leaving dir alone")
+
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("%w: restore needs -from", errUsage)
+	}
+
+	cfg, err := sf.config(dir, true)
+	if err != nil {
+		return err
+	}
+	log := &logger{verbose: sf.verbose}
+
+	if *verify {
+		if err := raftpebbledb.VerifyBackup(*from, log, cfg); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "backup %s is valid\n", *from)
+		return nil
+	}
+
+	if err := raftpebbledb.RestoreBackup(*from, dir, log, cfg); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "restored %s from %s\n", dir, *from)
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/raft"
+)
+
+func runInfo(args []string, stdout io.Writer) error {
+	var sf storeFlags
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	sf.register(fs)
+
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	store, closeStore, err := sf.openStore(dir, false)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	first, err := store.FirstIndex()
+	if err != nil {
+		return err
+	}
+
+	last, err := store.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "first index: %d\nlast index:  %d\n", first, last)
+
+	return nil
+}
+
+// logEntry is the JSON form of a dumped raft.Log. Data is embedded as is
+// when it is valid JSON and hex encoded otherwise.
+type logEntry struct {
+	Index      uint64          `json:"index"`
+	Term       uint64          `json:"term"`
+	Type       string          `json:"type"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	Extensions string          `json:"extensions,omitempty"`
+	AppendedAt *time.Time      `json:"appended_at,omitempty"`
+}
+
+func runLogs(args []string, stdout io.Writer) error {
+	var sf storeFlags
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	sf.register(fs)
+	from := fs.Uint64("from", 0, "first index to dump; the store's first index by default")
+	to := fs.Uint64("to", math.MaxUint64, "last index to dump")
+	format := fs.String("format", "hex", "output format: hex or json")
+
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *format != "hex" && *format != "json" {
+		return fmt.Errorf("%w: unknown format %q", errUsage, *format)
+	}
+
+	store, closeStore, err := sf.openStore(dir, false)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	first, err := store.FirstIndex()
+	if err != nil {
+		return err
+	}
+
+	last, err := store.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	lo, hi := max(*from, first), min(*to, last)
+	enc := json.NewEncoder(stdout)
+
+	for lo <= hi && lo != 0 {
+		logs, err := store.GetLogs(lo, hi, 4*1024*1024)
+		if err == raft.ErrLogNotFound {
+			// A gap left by DeleteRange
+			if lo, err = store.NextIndex(lo); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, log := range logs {
+			if *format == "json" {
+				if err := enc.Encode(newLogEntry(&log)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			fmt.Fprintf(stdout, "%d\t%d\t%s\t%s\n", log.Index, log.Term, log.Type, hex.EncodeToString(log.Data))
+		}
+
+		lo = logs[len(logs)-1].Index + 1
+		if lo == 0 {
+			break
+		}
+	}
+
+	return nil
+}
+
+func newLogEntry(log *raft.Log) *logEntry {
+	entry := &logEntry{
+		Index:      log.Index,
+		Term:       log.Term,
+		Type:       log.Type.String(),
+		Extensions: hex.EncodeToString(log.Extensions),
+	}
+
+	if json.Valid(log.Data) {
+		entry.Data = log.Data
+	} else if len(log.Data) > 0 {
+		entry.Data, _ = json.Marshal(hex.EncodeToString(log.Data))
+	}
+
+	if !log.AppendedAt.IsZero() {
+		entry.AppendedAt = &log.AppendedAt
+	}
+
+	return entry
+}
+
+func runStable(args []string, stdout io.Writer) error {
+	var sf storeFlags
+	fs := flag.NewFlagSet("stable", flag.ContinueOnError)
+	sf.register(fs)
+
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	store, closeStore, err := sf.openStore(dir, false)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	err = store.ForEach(func(key, val []byte) error {
+		_, err := fmt.Fprintf(stdout, "%s\t%s\n", printable(key), printable(val))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.ForEachUint64(func(key []byte, val uint64) error {
+		_, err := fmt.Fprintf(stdout, "%s\t%d\n", printable(key), val)
+		return err
+	})
+}
+
+// printable returns b as text when it is printable UTF-8 and hex otherwise.
+func printable(b []byte) string {
+	if utf8.Valid(b) {
+		s := string(b)
+		if q := strconv.Quote(s); q[1:len(q)-1] == s {
+			return s
+		}
+	}
+	return "0x" + hex.EncodeToString(b)
+}
+
+func runMetrics(args []string, stdout io.Writer) error {
+	var sf storeFlags
+	fs := flag.NewFlagSet("metrics", flag.ContinueOnError)
+	sf.register(fs)
+
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	engine, err := sf.openEngine(dir, false)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	m, err := engine.Metrics()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprint(stdout, m.String())
+	fmt.Fprintf(stdout, "disk usage: %d bytes\n", m.DiskSpaceUsage())
+
+	return nil
+}
+
+func runGroups(args []string, stdout io.Writer) error {
+	var sf storeFlags
+	fs := flag.NewFlagSet("groups", flag.ContinueOnError)
+	sf.register(fs)
+
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	engine, err := sf.openEngine(dir, false)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	groups, err := engine.Groups()
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		fmt.Fprintln(stdout, group)
+	}
+
+	return nil
+}
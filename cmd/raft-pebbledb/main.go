@@ -0,0 +1,183 @@
+// Command raft-pebbledb inspects and maintains raft-pebbledb directories
+// offline. Stores are opened read-only unless the command writes to them.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	raftpebbledb "github.com/xkeyideal/raft-pebbledb"
+)
+
+type command struct {
+	usage string
+	run   func(args []string, stdout io.Writer) error
+}
+
+var commands = map[string]command{
+	"info":    {"info [flags] <dir>\n\tprint the first and last log index", runInfo},
+	"logs":    {"logs [flags] <dir>\n\tdump log entries", runLogs},
+	"stable":  {"stable [flags] <dir>\n\tlist the stable store keys, e.g. CurrentTerm and LastVoteCand", runStable},
+	"metrics": {"metrics [flags] <dir>\n\tprint the pebble level and metrics summary", runMetrics},
+	"groups":  {"groups [flags] <dir>\n\tlist the raft groups of a multi-group engine", runGroups},
+	"migrate": {"migrate -bolt <file> [flags] <dir>\n\tcopy a raft-boltdb file into a new store at dir", runMigrate},
+	"backup":  {"backup -out <backup> [flags] <dir>\n\tcopy the store at dir, which must not be in use, to a new backup directory", runBackup},
+	"restore": {"restore -from <backup> [flags] <dir>\n\tverify a backup and replace the store at dir with it", runRestore},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "raft-pebbledb: %s\n", err)
+		if errors.Is(err, errUsage) {
+			usage(os.Stderr)
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("bad usage")
+
+func run(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+	}
+
+	return cmd.run(args[1:], stdout)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: raft-pebbledb <command> [flags] <dir>\n\ncommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(w, "\nrun raft-pebbledb <command> -h for the flags of a command\n")
+}
+
+// storeFlags are the flags of every command opening a store.
+type storeFlags struct {
+	group   string
+	keyFile string
+	verbose bool
+}
+
+func (f *storeFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.group, "group", "", "raft group ID of a multi-group engine; empty for a standalone store")
+	fs.StringVar(&f.keyFile, "keyfile", "", "key file of an encrypted store")
+	fs.BoolVar(&f.verbose, "v", false, "print pebble's log")
+}
+
+// parse parses args into fs and returns the single directory argument.
+func parse(fs *flag.FlagSet, args []string) (string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+		}
+		return "", fmt.Errorf("%w: %s", errUsage, err)
+	}
+
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%w: %s expects one directory", errUsage, fs.Name())
+	}
+
+	return fs.Arg(0), nil
+}
+
+// config returns the configuration opening dir, read-only unless writable
+// is set.
+func (f *storeFlags) config(dir string, writable bool) (*raftpebbledb.PebbleDBConfig, error) {
+	cfg := raftpebbledb.DefaultPebbleDBConfig()
+	cfg.KVLRUCacheSize = 8 * 1024 * 1024
+
+	cfg.ReadOnly = !writable
+
+	if f.keyFile != "" {
+		provider, err := raftpebbledb.NewStaticKeyProvider(f.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.KeyProvider = provider
+	}
+
+	return cfg, nil
+}
+
+// openEngine opens dir, read-only unless writable is set.
+func (f *storeFlags) openEngine(dir string, writable bool) (*raftpebbledb.PebbleEngine, error) {
+	cfg, err := f.config(dir, writable)
+	if err != nil {
+		return nil, err
+	}
+
+	return raftpebbledb.NewPebbleEngine(dir, &logger{verbose: f.verbose}, cfg)
+}
+
+// openStore opens the standalone store or group of dir, read-only unless
+// writable is set. The returned func closes the store and its engine.
+func (f *storeFlags) openStore(dir string, writable bool) (*raftpebbledb.PebbleStore, func(), error) {
+	if f.group == "" {
+		cfg, err := f.config(dir, writable)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		store, err := raftpebbledb.NewPebbleStore(dir, &logger{verbose: f.verbose}, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, func() { store.Close() }, nil
+	}
+
+	group, err := strconv.ParseUint(f.group, 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: bad group %q", errUsage, f.group)
+	}
+
+	engine, err := f.openEngine(dir, writable)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, err := engine.Store(group)
+	if err != nil {
+		engine.Close()
+		return nil, nil, err
+	}
+
+	return store, func() { engine.Close() }, nil
+}
+
+// logger is the pebble.Logger of the tool, silent unless -v is given.
+type logger struct {
+	verbose bool
+}
+
+func (l *logger) Infof(format string, args ...interface{}) {
+	if l.verbose {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+func (l *logger) Fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	raftpebbledb "github.com/xkeyideal/raft-pebbledb"
+	bolt "go.etcd.io/bbolt"
+)
+
+type testLogger struct{}
+
+func (testLogger) Infof(format string, args ...interface{})  {}
+func (testLogger) Fatalf(format string, args ...interface{}) {}
+
+func testStoreDir(t *testing.T) string {
+	dir := t.TempDir()
+
+	store, err := raftpebbledb.NewPebbleStore(dir, testLogger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogCommand, Data: []byte(`{"op":"set"}`)},
+		{Index: 2, Term: 2, Type: raft.LogCommand, Data: []byte{0xff, 0x00}},
+		{Index: 3, Term: 2, Type: raft.LogNoop},
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("LastVoteCand"), []byte("node1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64([]byte("CurrentTerm"), 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return dir
+}
+
+func testRun(t *testing.T, args ...string) string {
+	var out bytes.Buffer
+	if err := run(args, &out); err != nil {
+		t.Fatalf("%v: %s", args, err)
+	}
+	return out.String()
+}
+
+func TestInspect(t *testing.T) {
+	dir := testStoreDir(t)
+
+	if out := testRun(t, "info", dir); !strings.Contains(out, "first index: 1") || !strings.Contains(out, "last index:  3") {
+		t.Fatalf("bad: %s", out)
+	}
+
+	out := testRun(t, "logs", "-from", "2", dir)
+	if out != "2\t2\tLogCommand\tff00\n3\t2\tLogNoop\t\n" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	out = testRun(t, "logs", "-format", "json", "-to", "2", dir)
+	if !strings.Contains(out, `"data":{"op":"set"}`) || !strings.Contains(out, `"data":"ff00"`) {
+		t.Fatalf("bad: %s", out)
+	}
+
+	out = testRun(t, "stable", dir)
+	if out != "LastVoteCand\tnode1\nCurrentTerm\t2\n" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	if out := testRun(t, "metrics", dir); !strings.Contains(out, "disk usage") {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The store was not modified
+	if out := testRun(t, "info", dir); !strings.Contains(out, "last index:  3") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestInspectGaps(t *testing.T) {
+	dir := testStoreDir(t)
+
+	store, err := raftpebbledb.NewPebbleStore(dir, testLogger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.DeleteRange(2, 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLogs([]*raft.Log{{Index: 1 << 40, Term: 3, Type: raft.LogNoop}}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	out := testRun(t, "logs", dir)
+	if out != "1\t1\tLogCommand\t7b226f70223a22736574227d\n3\t2\tLogNoop\t\n1099511627776\t3\tLogNoop\t\n" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestInspectGroups(t *testing.T) {
+	dir := t.TempDir()
+
+	engine, err := raftpebbledb.NewPebbleEngine(dir, testLogger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, group := range []uint64{7, 3} {
+		store, _ := engine.Store(group)
+		if err := store.StoreLogs([]*raft.Log{{Index: group, Term: 1}}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	engine.Close()
+
+	if out := testRun(t, "groups", dir); out != "3\n7\n" {
+		t.Fatalf("bad: %q", out)
+	}
+	if out := testRun(t, "info", "-group", "7", dir); !strings.Contains(out, "first index: 7") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"nope"}, {"info"}, {"logs", "-format", "xml", "dir"}} {
+		if err := run(args, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+			t.Fatalf("%v: expected usage error, got: %v", args, err)
+		}
+	}
+
+	if err := run([]string{"info", t.TempDir() + "/missing"}, &bytes.Buffer{}); err == nil {
+		t.Fatalf("expected error opening a missing dir")
+	}
+}
+
+// testBoltFile writes a raft-boltdb file holding logs 1-3 and conf.
+func testBoltFile(t *testing.T, conf map[string][]byte) string {
+	boltPath := filepath.Join(t.TempDir(), "raft.db")
+	db, err := bolt.Open(boltPath, 0600, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		logs, _ := tx.CreateBucket([]byte("logs"))
+		for i := uint64(1); i <= 3; i++ {
+			var buf []byte
+			if err := codec.NewEncoderBytes(&buf, &codec.MsgpackHandle{}).Encode(&raft.Log{Index: i, Term: 1}); err != nil {
+				return err
+			}
+			if err := logs.Put(binary.BigEndian.AppendUint64(nil, i), buf); err != nil {
+				return err
+			}
+		}
+		bucket, _ := tx.CreateBucket([]byte("conf"))
+		for k, v := range conf {
+			if err := bucket.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return boltPath
+}
+
+func TestMigrate(t *testing.T) {
+	boltPath := testBoltFile(t, map[string][]byte{"CurrentTerm": binary.BigEndian.AppendUint64(nil, 1)})
+
+	dir := filepath.Join(t.TempDir(), "pebble")
+	if out := testRun(t, "migrate", "-bolt", boltPath, dir); out != "migrated 3 log entries (1-3) and 1 stable keys\n" {
+		t.Fatalf("bad: %q", out)
+	}
+	if out := testRun(t, "stable", dir); out != "CurrentTerm\t1\n" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	if err := run([]string{"migrate", dir}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error, got: %v", err)
+	}
+}
+
+func TestMigrateFailed(t *testing.T) {
+	// The logs are copied before the bad term fails the migration
+	boltPath := testBoltFile(t, map[string][]byte{"CurrentTerm": {1, 2, 3}})
+
+	// A destination the migration created is removed
+	dir := filepath.Join(t.TempDir(), "pebble")
+	if err := run([]string{"migrate", "-bolt", boltPath, dir}, &bytes.Buffer{}); err == nil {
+		t.Fatalf("expected error migrating a bad term")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got: %v", dir, err)
+	}
+
+	// One that existed before is left alone, and the error says so
+	dir = t.TempDir()
+	err := run([]string{"migrate", "-bolt", boltPath, dir}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "partial migration") {
+		t.Fatalf("expected partial migration error, got: %v", err)
+	}
+	if err := run([]string{"migrate", "-bolt", boltPath, dir}, &bytes.Buffer{}); !errors.Is(err, raftpebbledb.ErrStoreNotEmpty) {
+		t.Fatalf("expected not empty error, got: %v", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := testStoreDir(t)
+	backup := filepath.Join(t.TempDir(), "backup")
+
+	// A missing store is an error, and is not created
+	missing := filepath.Join(t.TempDir(), "missing")
+	if err := run([]string{"backup", "-out", backup, missing}, &bytes.Buffer{}); err == nil {
+		t.Fatalf("expected error backing up a missing store")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to stay missing, got: %v", missing, err)
+	}
+
+	if out := testRun(t, "backup", "-out", backup, dir); !strings.HasPrefix(out, "backed up") {
+		t.Fatalf("bad: %q", out)
+	}
+	if out := testRun(t, "restore", "-verify", "-from", backup, dir); !strings.HasSuffix(out, "is valid\n") {
+		t.Fatalf("bad: %q", out)
+	}
+
+	restored := filepath.Join(t.TempDir(), "restored")
+	if out := testRun(t, "restore", "-from", backup, restored); !strings.HasPrefix(out, "restored") {
+		t.Fatalf("bad: %q", out)
+	}
+	if out := testRun(t, "info", restored); !strings.Contains(out, "last index:  3") {
+		t.Fatalf("bad: %s", out)
+	}
+
+	if err := run([]string{"backup", dir}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error, got: %v", err)
+	}
+	if err := run([]string{"restore", dir}, &bytes.Buffer{}); !errors.Is(err, errUsage) {
+		t.Fatalf("expected usage error, got: %v", err)
+	}
+}
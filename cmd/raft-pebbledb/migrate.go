@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	raftpebbledb "github.com/xkeyideal/raft-pebbledb"
+)
+
+func runMigrate(args []string, stdout io.Writer) error {
+	var sf storeFlags
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	sf.register(fs)
+	boltPath := fs.String("bolt", "", "raft-boltdb file to migrate")
+	uint64Keys := fs.String("uint64-keys", "CurrentTerm,LastVoteTerm", "comma separated conf keys holding SetUint64 values")
+
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *boltPath == "" {
+		return fmt.Errorf("%w: migrate needs -bolt", errUsage)
+	}
+
+	// Fail before creating dir
+	if _, err := os.Stat(*boltPath); err != nil {
+		return err
+	}
+
+	_, err = os.Stat(dir)
+	created := os.IsNotExist(err)
+
+	store, closeStore, err := sf.openStore(dir, true)
+	if err != nil {
+		return err
+	}
+
+	opts := &raftpebbledb.MigrateOptions{Uint64Keys: []string{}}
+	if *uint64Keys != "" {
+		opts.Uint64Keys = strings.Split(*uint64Keys, ",")
+	}
+
+	result, err := raftpebbledb.MigrateBoltDB(*boltPath, store, opts)
+	closeStore()
+
+	switch {
+	case err == nil:
+	case errors.Is(err, raftpebbledb.ErrStoreNotEmpty):
+		return err
+	case created:
+		// Nothing but the partial migration lives in dir
+		if rmErr := os.RemoveAll(dir); rmErr != nil {
+			return fmt.Errorf("%w; removing the partial migration in %s: %v", err, dir, rmErr)
+		}
+		return err
+	default:
+		return fmt.Errorf("%w; %s now holds a partial migration that must be removed before retrying", err, dir)
+	}
+
+	fmt.Fprintf(stdout, "migrated %d log entries (%d-%d) and %d stable keys\n",
+		result.Logs, result.FirstIndex, result.LastIndex, result.StableKeys)
+
+	return nil
+}
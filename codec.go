@@ -0,0 +1,315 @@
+package raftpebbledb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// LogCodec selects the encoding StoreLogs uses for new entries. Entries are
+// always decoded according to their own format, so switching codecs never
+// makes existing logs unreadable.
+type LogCodec int
+
+const (
+	// CodecBinary is a compact hand-written encoding, see encodeBinaryLog.
+	CodecBinary LogCodec = iota
+
+	// CodecMsgpack is the original go-msgpack encoding of raft.Log.
+	CodecMsgpack
+)
+
+func (c LogCodec) String() string {
+	switch c {
+	case CodecBinary:
+		return "binary"
+	case CodecMsgpack:
+		return "msgpack"
+	}
+	return "unknown"
+}
+
+// Leading format byte of a stored log value. A msgpack encoded raft.Log is a
+// map, whose first byte is always >= 0x80, so it can never be mistaken for
+// one of these.
+const (
+	logFormatBinaryV1 byte = 0x01
+
+	// logFormatChecksum wraps an entry of any other format:
+	// format(1) crc32c(4, big endian) entry. The CRC covers the 8 byte big
+	// endian log index followed by entry, so an entry stored under the
+	// wrong key is caught as well as a damaged one.
+	logFormatChecksum byte = 0x02
+)
+
+const checksumHeaderSize = 5
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptLogError is returned when a stored log entry fails its checksum or
+// cannot be decoded. Index names the entry so operators can resnapshot.
+type CorruptLogError struct {
+	Index uint64
+	Err   error
+}
+
+func (e *CorruptLogError) Error() string {
+	return fmt.Sprintf("%s at index %d: %v", ErrCorruptLog, e.Index, e.Err)
+}
+
+func (e *CorruptLogError) Is(target error) bool {
+	return target == ErrCorruptLog
+}
+
+func (e *CorruptLogError) Unwrap() error {
+	return e.Err
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// Flags of the binary format. At most one of the data compression flags is
+// set.
+const (
+	binaryFlagAppendedAt byte = 1 << iota
+	binaryFlagSnappy
+	binaryFlagZstd
+)
+
+var errCorruptBinaryLog = errors.New("corrupt binary log entry")
+
+// logCodec turns raft.Log values into stored bytes and back according to the
+// engine's configuration.
+type logCodec struct {
+	writer      LogCodec
+	compression Compression
+	threshold   int
+	stats       *compressionStats
+}
+
+func newLogCodec(cfg *PebbleDBConfig) (*logCodec, error) {
+	if cfg.LogCompression != CompressionNone && cfg.LogCodec != CodecBinary {
+		return nil, fmt.Errorf("log compression %s requires the binary codec", cfg.LogCompression)
+	}
+
+	return &logCodec{
+		writer:      cfg.LogCodec,
+		compression: cfg.LogCompression,
+		threshold:   cfg.LogCompressionThreshold,
+		stats:       &compressionStats{},
+	}, nil
+}
+
+// encode encodes log with the configured writer codec and seals it with a
+// checksum.
+func (c *logCodec) encode(log *raft.Log) ([]byte, error) {
+	var entry []byte
+	if c.writer == CodecMsgpack {
+		buf, err := encodeMsgPack(log)
+		if err != nil {
+			return nil, err
+		}
+		entry = buf.Bytes()
+	} else {
+		entry = c.encodeBinary(log)
+	}
+
+	buf := make([]byte, checksumHeaderSize+len(entry))
+	buf[0] = logFormatChecksum
+	binary.BigEndian.PutUint32(buf[1:], logChecksum(log.Index, entry))
+	copy(buf[checksumHeaderSize:], entry)
+
+	return buf, nil
+}
+
+// decode decodes the value stored for index, written by any codec, into log.
+// Checksummed values are verified first; any failure is a CorruptLogError.
+// The returned log never aliases buf.
+func (c *logCodec) decode(index uint64, buf []byte, log *raft.Log) error {
+	if len(buf) > 0 && buf[0] == logFormatChecksum {
+		if len(buf) < checksumHeaderSize {
+			return &CorruptLogError{Index: index, Err: errCorruptBinaryLog}
+		}
+		entry := buf[checksumHeaderSize:]
+		if binary.BigEndian.Uint32(buf[1:]) != logChecksum(index, entry) {
+			return &CorruptLogError{Index: index, Err: errChecksumMismatch}
+		}
+		buf = entry
+	}
+
+	var err error
+	if len(buf) > 0 && buf[0] == logFormatBinaryV1 {
+		err = c.decodeBinary(buf, log)
+	} else {
+		err = decodeMsgPack(buf, log)
+	}
+
+	if err != nil {
+		return &CorruptLogError{Index: index, Err: err}
+	}
+
+	if log.Index != index {
+		return &CorruptLogError{Index: index, Err: fmt.Errorf("entry holds index %d", log.Index)}
+	}
+
+	return nil
+}
+
+func logChecksum(index uint64, entry []byte) uint32 {
+	crc := crc32.Checksum(uint64ToBytes(index), castagnoli)
+	return crc32.Update(crc, castagnoli, entry)
+}
+
+// encodeBinary lays out log as
+//
+//	format(1) flags(1) index(uvarint) term(uvarint) type(1)
+//	[len(raw data)(uvarint), when the data is compressed]
+//	len(data)(uvarint) data len(extensions)(uvarint) extensions
+//	[appendedAt unix nanos(varint), when binaryFlagAppendedAt is set]
+func (c *logCodec) encodeBinary(log *raft.Log) []byte {
+	var flags byte
+	if !log.AppendedAt.IsZero() {
+		flags |= binaryFlagAppendedAt
+	}
+
+	data := log.Data
+	if c.compression != CompressionNone && len(data) >= c.threshold {
+		if compressed, ok := c.compress(data); ok {
+			data = compressed
+			flags |= c.compression.flag()
+		}
+	}
+
+	size := 3 + 5*binary.MaxVarintLen64 + len(data) + len(log.Extensions)
+	buf := make([]byte, 0, size)
+
+	buf = append(buf, logFormatBinaryV1, flags)
+	buf = binary.AppendUvarint(buf, log.Index)
+	buf = binary.AppendUvarint(buf, log.Term)
+	buf = append(buf, byte(log.Type))
+	if flags&(binaryFlagSnappy|binaryFlagZstd) != 0 {
+		buf = binary.AppendUvarint(buf, uint64(len(log.Data)))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	buf = append(buf, data...)
+	buf = binary.AppendUvarint(buf, uint64(len(log.Extensions)))
+	buf = append(buf, log.Extensions...)
+
+	if flags&binaryFlagAppendedAt != 0 {
+		buf = binary.AppendVarint(buf, log.AppendedAt.UnixNano())
+	}
+
+	return buf
+}
+
+func (c *logCodec) decodeBinary(buf []byte, log *raft.Log) error {
+	if len(buf) < 2 {
+		return errCorruptBinaryLog
+	}
+
+	flags := buf[1]
+	d := binaryDecoder{buf: buf[2:]}
+
+	log.Index = d.uvarint()
+	log.Term = d.uvarint()
+	log.Type = raft.LogType(d.byte())
+
+	if algo := compressionFromFlags(flags); algo != CompressionNone {
+		rawLen := d.uvarint()
+		compressed := d.view()
+		if d.err != nil {
+			return d.err
+		}
+		data, err := c.decompress(algo, compressed, rawLen)
+		if err != nil {
+			return err
+		}
+		log.Data = data
+	} else {
+		log.Data = d.bytes()
+	}
+
+	log.Extensions = d.bytes()
+	log.AppendedAt = time.Time{}
+
+	if flags&binaryFlagAppendedAt != 0 {
+		log.AppendedAt = time.Unix(0, d.varint())
+	}
+
+	return d.err
+}
+
+// binaryDecoder reads fields sequentially, remembering the first error so
+// callers only check once at the end.
+type binaryDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errCorruptBinaryLog
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *binaryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errCorruptBinaryLog
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *binaryDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 1 {
+		d.err = errCorruptBinaryLog
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+// bytes returns a copy of a length-prefixed field, nil when it is empty.
+func (d *binaryDecoder) bytes() []byte {
+	v := d.view()
+	if len(v) == 0 {
+		return nil
+	}
+	b := make([]byte, len(v))
+	copy(b, v)
+	return b
+}
+
+// view returns a length-prefixed field without copying it.
+func (d *binaryDecoder) view() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)) < n {
+		d.err = errCorruptBinaryLog
+		return nil
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v
+}
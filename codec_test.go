@@ -0,0 +1,226 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func testLogCodec(writer LogCodec) *logCodec {
+	return &logCodec{writer: writer, stats: &compressionStats{}}
+}
+
+func testFullRaftLog(idx uint64) *raft.Log {
+	return &raft.Log{
+		Index:      idx,
+		Term:       42,
+		Type:       raft.LogConfiguration,
+		Data:       []byte("some data"),
+		Extensions: []byte("ext"),
+		AppendedAt: time.Unix(1700000000, 123456789),
+	}
+}
+
+func TestCodec_BinaryRoundTrip(t *testing.T) {
+	for _, in := range []*raft.Log{
+		testFullRaftLog(1),
+		testRaftLog(2, "log2"),
+		{Index: 1<<64 - 1},
+	} {
+		buf := testLogCodec(CodecBinary).encodeBinary(in)
+		if buf[0] != logFormatBinaryV1 {
+			t.Fatalf("bad format byte: %x", buf[0])
+		}
+
+		out := new(raft.Log)
+		if err := testLogCodec(CodecBinary).decode(in.Index, buf, out); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !out.AppendedAt.Equal(in.AppendedAt) {
+			t.Fatalf("bad appended at: %v", out.AppendedAt)
+		}
+		out.AppendedAt = in.AppendedAt
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("bad: %#v", out)
+		}
+
+		// Decoded slices must not alias the stored value
+		for i := range buf {
+			buf[i] = 0
+		}
+		if !reflect.DeepEqual(in.Data, out.Data) {
+			t.Fatalf("decoded data aliases the input")
+		}
+	}
+}
+
+func TestCodec_BinaryCorrupt(t *testing.T) {
+	buf := testLogCodec(CodecBinary).encodeBinary(testFullRaftLog(1))
+	for i := 0; i < len(buf); i++ {
+		if err := testLogCodec(CodecBinary).decode(1, buf[:i], new(raft.Log)); err == nil {
+			t.Fatalf("expected error decoding %d of %d bytes", i, len(buf))
+		}
+	}
+}
+
+func TestCodec_MsgpackNeverLooksBinary(t *testing.T) {
+	buf, err := encodeMsgPack(testFullRaftLog(1))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if buf.Bytes()[0] < 0x80 {
+		t.Fatalf("bad first msgpack byte: %x", buf.Bytes()[0])
+	}
+}
+
+func TestPebbleStore_MixedCodecs(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.LogCodec = CodecMsgpack
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	cfg.LogCodec = CodecBinary
+	store, err := NewPebbleStore(store.path, &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(3, "log3")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	logs, err := store.GetLogs(1, 3, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i, log := range logs {
+		expected := testRaftLog(uint64(i+1), "log"+string(rune('1'+i)))
+		if !reflect.DeepEqual(&log, expected) {
+			t.Fatalf("bad: %#v", log)
+		}
+	}
+}
+
+func BenchmarkCodec_EncodeMsgpack(b *testing.B) {
+	log := testFullRaftLog(1)
+	log.Data = randomBytes(256)
+	codec := testLogCodec(CodecMsgpack)
+	for n := 0; n < b.N; n++ {
+		codec.encode(log)
+	}
+}
+
+func BenchmarkCodec_EncodeBinary(b *testing.B) {
+	log := testFullRaftLog(1)
+	log.Data = randomBytes(256)
+	codec := testLogCodec(CodecBinary)
+	for n := 0; n < b.N; n++ {
+		codec.encode(log)
+	}
+}
+
+func BenchmarkCodec_DecodeMsgpack(b *testing.B) {
+	log := testFullRaftLog(1)
+	log.Data = randomBytes(256)
+	codec := testLogCodec(CodecMsgpack)
+	buf, _ := codec.encode(log)
+	for n := 0; n < b.N; n++ {
+		codec.decode(1, buf, new(raft.Log))
+	}
+}
+
+func BenchmarkCodec_DecodeBinary(b *testing.B) {
+	log := testFullRaftLog(1)
+	log.Data = randomBytes(256)
+	codec := testLogCodec(CodecBinary)
+	buf, _ := codec.encode(log)
+	for n := 0; n < b.N; n++ {
+		codec.decode(1, buf, new(raft.Log))
+	}
+}
+
+func TestPebbleStore_Checksum(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	logs := []*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2"), testRaftLog(3, "log3")}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	key := func(idx uint64) []byte {
+		return store.buildKey(store.logsPrefix, uint64ToBytes(idx))
+	}
+
+	// Flip a bit in the payload of entry 2
+	val, err := store.getBytes(key(2))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if val[0] != logFormatChecksum {
+		t.Fatalf("entry is not checksummed: %x", val[0])
+	}
+	val[len(val)-1] ^= 0x01
+	if err := store.db.Set(key(2), val, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Copy entry 1 under the key of entry 3
+	val, _ = store.getBytes(key(1))
+	if err := store.db.Set(key(3), val, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, idx := range []uint64{2, 3} {
+		err := store.GetLog(idx, new(raft.Log))
+		if !errors.Is(err, ErrCorruptLog) {
+			t.Fatalf("expected corrupt log error, got: %v", err)
+		}
+		var corrupt *CorruptLogError
+		if !errors.As(err, &corrupt) || corrupt.Index != idx {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+
+	if _, err := store.GetLogs(1, 3, 0); !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("expected corrupt log error, got: %v", err)
+	}
+	if err := store.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestPebbleStore_LegacyMsgpackEntries(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	// Entries written before checksums were introduced are plain msgpack
+	expected := testRaftLog(1, "log1")
+	buf, err := encodeMsgPack(expected)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.db.Set(store.buildKey(store.logsPrefix, uint64ToBytes(1)), buf.Bytes(), nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	log := new(raft.Log)
+	if err := store.GetLog(1, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("bad: %#v", log)
+	}
+}
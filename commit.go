@@ -0,0 +1,240 @@
+package raftpebbledb
+
+import (
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+// maxGroupCommitSize bounds how many requests are merged into one batch so a
+// steady stream of writers cannot hold a group open forever.
+const maxGroupCommitSize = 256
+
+// commitRequest is a single caller's write. StoreLogs sets logs, min and max
+// so the committer can validate monotonicity and move the cached indexes of
+// store; Set and SetUint64 leave them empty and set stable instead.
+type commitRequest struct {
+	store    *PebbleStore
+	batch    *pebble.Batch
+	stable   bool
+	logs     []*raft.Log
+	min, max uint64
+	done     chan error
+
+	// size is the encoded size of logs and sizes that of each entry.
+	// replaced and replacedSize are the entries they overwrite, counted
+	// before the commit when the store keeps a retention count.
+	size                   uint64
+	sizes                  []uint64
+	replaced, replacedSize uint64
+}
+
+// commit writes the request's batch durably. With group commit disabled the
+// batch is committed on the caller's goroutine, otherwise it is handed to the
+// committer and the caller blocks until the group containing it is committed.
+func (e *PebbleEngine) commit(req *commitRequest) error {
+	if err := e.writable(); err != nil {
+		return err
+	}
+
+	if e.commitc == nil {
+		return e.commitGroup([]*commitRequest{req})[0]
+	}
+
+	req.done = make(chan error, 1)
+
+	select {
+	case e.commitc <- req:
+	case <-e.stopc:
+		return pebble.ErrClosed
+	}
+
+	return <-req.done
+}
+
+// runCommitter collects requests arriving within window of the first one and
+// commits them as a single batch. commitc is unbuffered, so once the
+// committer has returned no request can be left waiting on it.
+func (e *PebbleEngine) runCommitter(window time.Duration) {
+	defer e.bg.Done()
+
+	for {
+		var group []*commitRequest
+
+		select {
+		case req := <-e.commitc:
+			group = append(group, req)
+		case <-e.stopc:
+			return
+		}
+
+		timer := time.NewTimer(window)
+	collect:
+		for len(group) < maxGroupCommitSize {
+			select {
+			case req := <-e.commitc:
+				group = append(group, req)
+			case <-timer.C:
+				break collect
+			case <-e.stopc:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		for i, err := range e.commitGroup(group) {
+			group[i].done <- err
+		}
+	}
+}
+
+// commitGroup validates and commits reqs in order and returns one error per
+// request. A request rejected by the monotonic check fails on its own without
+// affecting the rest of the group; a failed commit fails every accepted one.
+// Requests may belong to different raft groups, each validated against its
+// own log.
+func (e *PebbleEngine) commitGroup(reqs []*commitRequest) []error {
+	errs := make([]error, len(reqs))
+
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	lasts := make(map[*PebbleStore]uint64)
+	accepted := make([]*commitRequest, 0, len(reqs))
+	for i, req := range reqs {
+		if len(req.logs) > 0 {
+			last, ok := lasts[req.store]
+			if !ok {
+				last = req.store.lastIndex.Load()
+			}
+			if e.monotonic {
+				if err := checkMonotonic(last, req.logs); err != nil {
+					errs[i] = err
+					continue
+				}
+			}
+			if req.max > last {
+				last = req.max
+			}
+			lasts[req.store] = last
+		}
+		accepted = append(accepted, req)
+	}
+
+	if len(accepted) == 0 {
+		return errs
+	}
+
+	// Entries about to be overwritten leave the retention count, whether
+	// they are committed or written by an earlier request of the group.
+	// written holds the size of every entry stored earlier in the group.
+	written := make(map[*PebbleStore]map[uint64]uint64)
+	for _, req := range accepted {
+		if len(req.logs) == 0 || req.store.retention == nil {
+			continue
+		}
+		w, ok := written[req.store]
+		if !ok {
+			w = make(map[uint64]uint64)
+			written[req.store] = w
+		}
+		replaced, size, err := req.store.replacedSizes(req.min, req.max, w)
+		if err != nil {
+			for i := range reqs {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			}
+			return errs
+		}
+		req.replaced, req.replacedSize = replaced, size
+
+		for i, log := range req.logs {
+			w[log.Index] = req.sizes[i]
+		}
+	}
+
+	// The group is synced if any member's durability mode asks for it
+	opts := pebble.NoSync
+	for _, req := range accepted {
+		if e.durability.writeOptions(req.stable).Sync {
+			opts = pebble.Sync
+			break
+		}
+	}
+
+	batch := accepted[0].batch
+	if len(accepted) > 1 {
+		batch = e.db.NewBatch()
+		defer batch.Close()
+
+		for _, req := range accepted {
+			if err := batch.Apply(req.batch, nil); err != nil {
+				for i := range reqs {
+					if errs[i] == nil {
+						errs[i] = err
+					}
+				}
+				return errs
+			}
+		}
+	}
+
+	err := batch.Commit(opts)
+	for i := range reqs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+
+	if err != nil {
+		return errs
+	}
+
+	for _, req := range accepted {
+		if len(req.logs) > 0 {
+			overwrote := req.min <= req.store.lastIndex.Load()
+			req.store.advanceIndexes(req.min, req.max)
+			req.store.feed.stored(req.min, overwrote)
+			if t := req.store.retention; t != nil {
+				t.add(uint64(len(req.logs)), req.size, req.replaced, req.replacedSize)
+				t.forget(req.min)
+				req.store.checkRetention()
+			}
+		}
+	}
+
+	return errs
+}
+
+// runSyncer makes the WAL durable every interval for SyncPeriodic.
+func (e *PebbleEngine) runSyncer(interval time.Duration) {
+	defer e.bg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.db.LogData(nil, pebble.Sync); err != nil {
+				e.logger.Infof("pebbledb periodic sync error: %s\n", err.Error())
+			}
+		case <-e.stopc:
+			return
+		}
+	}
+}
+
+// advanceIndexes widens the cached bounds to cover a committed [min, max].
+// Last is published before first so a concurrent reader of an empty store
+// never observes first > last.
+func (ps *PebbleStore) advanceIndexes(min, max uint64) {
+	if max > ps.lastIndex.Load() {
+		ps.lastIndex.Store(max)
+	}
+	if first := ps.firstIndex.Load(); first == 0 || min < first {
+		ps.firstIndex.Store(min)
+	}
+}
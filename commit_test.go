@@ -0,0 +1,177 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+)
+
+// testGroupCommitStore opens an in-memory store whose WAL syncs are counted.
+// The window is long enough that a group only closes once it holds
+// maxGroupCommitSize requests, so tests fill it exactly instead of racing a
+// timer.
+func testGroupCommitStore(t *testing.T, monotonic bool) (*PebbleStore, *crashFS) {
+	t.Helper()
+
+	fs := newCrashFS(vfs.NewMem(), 0)
+
+	cfg := DefaultPebbleDBConfig()
+	cfg.FS = fs
+	cfg.Monotonic = monotonic
+	cfg.GroupCommitWindow = time.Minute
+
+	store, err := NewPebbleStoreInMemory(&Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return store, fs
+}
+
+// testCommitConcurrently runs every write on its own goroutine and returns
+// their errors in order.
+func testCommitConcurrently(writes []func() error) []error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(writes))
+	for i, write := range writes {
+		wg.Add(1)
+		go func(i int, write func() error) {
+			defer wg.Done()
+			errs[i] = write()
+		}(i, write)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestPebbleStore_GroupCommit(t *testing.T) {
+	store, fs := testGroupCommitStore(t, false)
+	defer store.Close()
+
+	const writers = maxGroupCommitSize / 2
+
+	var writes []func() error
+	for i := 0; i < writers; i++ {
+		idx := uint64(i*2 + 1)
+		key := []byte(fmt.Sprintf("key%d", i))
+		val := uint64(i)
+		writes = append(writes, func() error {
+			return store.StoreLogs([]*raft.Log{
+				testRaftLog(idx, fmt.Sprintf("log%d", idx)),
+				testRaftLog(idx+1, fmt.Sprintf("log%d", idx+1)),
+			})
+		}, func() error {
+			return store.SetUint64(key, val)
+		})
+	}
+
+	syncs := fs.syncs.Load()
+	for _, err := range testCommitConcurrently(writes) {
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Every request was acknowledged by a single synced commit
+	if n := fs.syncs.Load() - syncs; n != 1 {
+		t.Fatalf("bad: %d syncs for %d requests", n, len(writes))
+	}
+
+	first, _ := store.FirstIndex()
+	last, _ := store.LastIndex()
+	if first != 1 || last != writers*2 {
+		t.Fatalf("bad indexes: %d %d", first, last)
+	}
+
+	for i := uint64(1); i <= writers*2; i++ {
+		log := new(raft.Log)
+		if err := store.GetLog(i, log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if string(log.Data) != fmt.Sprintf("log%d", i) {
+			t.Fatalf("bad: %#v", log)
+		}
+	}
+
+	for i := 0; i < writers; i++ {
+		val, err := store.GetUint64([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if val != uint64(i) {
+			t.Fatalf("bad: %v", val)
+		}
+	}
+}
+
+func TestPebbleStore_GroupCommitMonotonic(t *testing.T) {
+	store, fs := testGroupCommitStore(t, true)
+	defer store.Close()
+
+	// Each round fills a group, so it commits without waiting out the window
+	var writes []func() error
+	for i := 0; i < maxGroupCommitSize; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		writes = append(writes, func() error {
+			return store.SetUint64(key, 1)
+		})
+	}
+	writes[0] = func() error {
+		return store.StoreLogs([]*raft.Log{testRaftLog(1, "log1")})
+	}
+	for _, err := range testCommitConcurrently(writes) {
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Both requests land in the same group; only the one leaving a gap fails
+	writes[0] = func() error {
+		return store.StoreLogs([]*raft.Log{testRaftLog(2, "log2")})
+	}
+	writes[1] = func() error {
+		return store.StoreLogs([]*raft.Log{testRaftLog(4, "log4")})
+	}
+
+	syncs := fs.syncs.Load()
+	errs := testCommitConcurrently(writes)
+	if n := fs.syncs.Load() - syncs; n != 1 {
+		t.Fatalf("bad: %d syncs for %d requests", n, len(writes))
+	}
+
+	if errs[0] != nil {
+		t.Fatalf("err: %s", errs[0])
+	}
+	if !errors.Is(errs[1], ErrNonMonotonicLogs) {
+		t.Fatalf("expected non-monotonic error, got: %v", errs[1])
+	}
+	for _, err := range errs[2:] {
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	last, _ := store.LastIndex()
+	if last != 2 {
+		t.Fatalf("bad: %d", last)
+	}
+}
+
+func TestPebbleStore_GroupCommitClosed(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.GroupCommitWindow = time.Millisecond
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("k"), []byte("v")); err == nil {
+		t.Fatalf("expected error on closed store")
+	}
+}
@@ -0,0 +1,237 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"go.uber.org/atomic"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// LogCompactionStats reports the compactions of deleted log ranges since the
+// engine was opened. Sizes are pebble's estimates of the space used on disk.
+type LogCompactionStats struct {
+	// Ranges compacted, and the space they freed
+	Compactions    uint64
+	ReclaimedBytes uint64
+
+	// Deleted by DeleteRange and not compacted yet
+	PendingBytes uint64
+}
+
+// keyRange is a deleted span of keys, [start, end), and its size on disk
+// when it was deleted.
+type keyRange struct {
+	start, end []byte
+	size       uint64
+}
+
+// logCompactor collects the log ranges deleted by DeleteRange until they are
+// compacted, either by the background compactor once they add up to
+// threshold bytes or by CompactLogs.
+type logCompactor struct {
+	threshold uint64
+
+	// wakec wakes the background compactor; a pending wake is enough
+	wakec chan struct{}
+
+	mu      sync.Mutex
+	pending []keyRange
+	size    uint64
+
+	compactions *atomic.Uint64
+	reclaimed   *atomic.Uint64
+}
+
+func newLogCompactor(threshold uint64) *logCompactor {
+	return &logCompactor{
+		threshold:   threshold,
+		wakec:       make(chan struct{}, 1),
+		compactions: atomic.NewUint64(0),
+		reclaimed:   atomic.NewUint64(0),
+	}
+}
+
+// add records a deleted range and wakes the compactor once the pending ranges
+// reach the threshold.
+func (c *logCompactor) add(r keyRange) {
+	if r.start == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.pending = mergeRanges(append(c.pending, r))
+	c.size += r.size
+	full := c.threshold > 0 && c.size >= c.threshold
+	c.mu.Unlock()
+
+	if full {
+		select {
+		case c.wakec <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take removes and returns the pending ranges whose keys start with prefix,
+// or all of them when prefix is nil.
+func (c *logCompactor) take(prefix []byte) []keyRange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var taken, kept []keyRange
+	for _, r := range c.pending {
+		if bytes.HasPrefix(r.start, prefix) {
+			taken = append(taken, r)
+			c.size -= r.size
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	c.pending = kept
+
+	return taken
+}
+
+func (c *logCompactor) stats() LogCompactionStats {
+	c.mu.Lock()
+	pending := c.size
+	c.mu.Unlock()
+
+	return LogCompactionStats{
+		Compactions:    c.compactions.Load(),
+		ReclaimedBytes: c.reclaimed.Load(),
+		PendingBytes:   pending,
+	}
+}
+
+// mergeRanges sorts ranges and merges those that overlap or touch, so a key
+// is never compacted twice.
+func mergeRanges(ranges []keyRange) []keyRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if bytes.Compare(r.start, last.end) > 0 {
+			merged = append(merged, r)
+			continue
+		}
+		if bytes.Compare(r.end, last.end) > 0 {
+			last.end = r.end
+		}
+		last.size += r.size
+	}
+
+	return merged
+}
+
+// compactRanges compacts each range and accounts for the space it frees.
+func (e *PebbleEngine) compactRanges(ranges []keyRange) error {
+	for _, r := range ranges {
+		before, err := e.db.EstimateDiskUsage(r.start, r.end)
+		if err != nil {
+			return err
+		}
+
+		if err := e.db.Compact(r.start, r.end, false); err != nil {
+			return err
+		}
+
+		after, err := e.db.EstimateDiskUsage(r.start, r.end)
+		if err != nil {
+			return err
+		}
+
+		e.compactor.compactions.Inc()
+		if before > after {
+			e.compactor.reclaimed.Add(before - after)
+		}
+	}
+
+	return nil
+}
+
+// runCompactor compacts the pending log ranges whenever they reach the
+// threshold. A compaction in progress delays Close until it is done.
+func (e *PebbleEngine) runCompactor() {
+	defer e.bg.Done()
+
+	for {
+		select {
+		case <-e.compactor.wakec:
+			if err := e.compactRanges(e.compactor.take(nil)); err != nil {
+				e.logger.Infof("pebbledb log compaction error: %s\n", err.Error())
+			}
+		case <-e.stopc:
+			return
+		}
+	}
+}
+
+// LogCompactionStats reports the compactions of deleted log ranges of every
+// group.
+func (e *PebbleEngine) LogCompactionStats() LogCompactionStats {
+	return e.compactor.stats()
+}
+
+// trackDeletedLogs estimates the disk space of the logs in [start, end)
+// before DeleteRange removes them. The range is handed to the compactor once
+// the delete has been committed.
+func (ps *PebbleStore) trackDeletedLogs(start, end []byte) (keyRange, error) {
+	if bytes.Compare(start, end) >= 0 {
+		return keyRange{}, nil
+	}
+
+	size, err := ps.db.EstimateDiskUsage(start, end)
+	if err != nil {
+		return keyRange{}, err
+	}
+
+	return keyRange{start: start, end: end, size: size}, nil
+}
+
+// CompactLogs compacts the log ranges of the store deleted since their last
+// compaction, together with the log before FirstIndex and after LastIndex,
+// which only holds deleted entries. It reclaims their space and drops their
+// range tombstones now rather than when the background compactor or pebble
+// get to them, and covers ranges deleted before the store was reopened.
+func (ps *PebbleStore) CompactLogs() error {
+	if !ps.acquire() {
+		return pebble.ErrClosed
+	}
+	defer ps.release()
+
+	if err := ps.engine.writable(); err != nil {
+		return err
+	}
+
+	ranges := ps.engine.compactor.take(ps.logsPrefix)
+
+	first, last := ps.firstIndex.Load(), ps.lastIndex.Load()
+	if last == 0 {
+		ranges = append(ranges, keyRange{start: ps.logsPrefix, end: prefixUpperBound(ps.logsPrefix)})
+	} else {
+		ranges = append(ranges,
+			keyRange{start: ps.logsPrefix, end: ps.buildKey(ps.logsPrefix, uint64ToBytes(first))},
+			keyRange{start: ps.logIterUpperBound(last), end: prefixUpperBound(ps.logsPrefix)},
+		)
+	}
+
+	var live []keyRange
+	for _, r := range ranges {
+		if bytes.Compare(r.start, r.end) < 0 {
+			live = append(live, r)
+		}
+	}
+
+	return ps.engine.compactRanges(mergeRanges(live))
+}
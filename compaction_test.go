@@ -0,0 +1,119 @@
+package raftpebbledb
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPebbleStore_CompactLogs(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.LogCompactionThreshold = 0
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	// Flushed to sstables, where deletes take space until compacted
+	testStoreLogRange(t, store, 1, 2000, 1, randomBytes(1024))
+	if err := store.db.Flush(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := store.DeleteRange(1, 1500); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	stats := store.Engine().LogCompactionStats()
+	if stats.PendingBytes == 0 || stats.Compactions != 0 {
+		t.Fatalf("bad: %+v", stats)
+	}
+
+	if err := store.CompactLogs(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	stats = store.Engine().LogCompactionStats()
+	if stats.PendingBytes != 0 || stats.Compactions == 0 || stats.ReclaimedBytes == 0 {
+		t.Fatalf("bad: %+v", stats)
+	}
+
+	if first, _ := store.FirstIndex(); first != 1501 {
+		t.Fatalf("bad: %d", first)
+	}
+	logs, err := store.GetLogs(1501, 2000, 0)
+	if err != nil || len(logs) != 500 {
+		t.Fatalf("bad: %d %v", len(logs), err)
+	}
+
+	// Nothing pending and an empty store are fine too
+	if err := store.CompactLogs(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.DeleteRange(1501, 2000); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.CompactLogs(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestPebbleStore_CompactLogsBackground(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.LogCompactionThreshold = 16 * 1024
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	// Flushed to sstables, where deletes take space until compacted
+	testStoreLogRange(t, store, 1, 1000, 1, randomBytes(1024))
+	if err := store.db.Flush(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Too small to trigger a compaction
+	if err := store.DeleteRange(1, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if stats := store.Engine().LogCompactionStats(); stats.Compactions != 0 {
+		t.Fatalf("bad: %+v", stats)
+	}
+
+	if err := store.DeleteRange(11, 500); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := store.Engine().LogCompactionStats()
+		if stats.Compactions > 0 && stats.PendingBytes == 0 {
+			if stats.ReclaimedBytes == 0 {
+				t.Fatalf("bad: %+v", stats)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no background compaction: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if first, _ := store.FirstIndex(); first != 501 {
+		t.Fatalf("bad: %d", first)
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	r := func(start, end string, size uint64) keyRange {
+		return keyRange{start: []byte(start), end: []byte(end), size: size}
+	}
+
+	merged := mergeRanges([]keyRange{r("e", "f", 1), r("a", "c", 2), r("b", "d", 3), r("d", "e", 4), r("x", "y", 5)})
+	if len(merged) != 2 ||
+		string(merged[0].start) != "a" || string(merged[0].end) != "f" || merged[0].size != 10 ||
+		string(merged[1].start) != "x" || merged[1].size != 5 {
+		t.Fatalf("bad: %+v", merged)
+	}
+}
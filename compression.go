@@ -0,0 +1,180 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm used to compress raft.Log.Data.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+func (c Compression) flag() byte {
+	switch c {
+	case CompressionSnappy:
+		return binaryFlagSnappy
+	case CompressionZstd:
+		return binaryFlagZstd
+	}
+	return 0
+}
+
+func compressionFromFlags(flags byte) Compression {
+	switch {
+	case flags&binaryFlagSnappy != 0:
+		return CompressionSnappy
+	case flags&binaryFlagZstd != 0:
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// maxPreallocSize caps the buffer allocated up front for decompression.
+const maxPreallocSize = 64 * 1024 * 1024
+
+var errDecompressedSize = errors.New("decompressed log data has the wrong size")
+
+// zstd encoders and decoders are safe for concurrent EncodeAll/DecodeAll, so
+// one of each serves every store.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// CompressionStats reports how well log payload compression is doing since
+// the engine was opened.
+type CompressionStats struct {
+	// Entries whose data was stored compressed, and their size before and
+	// after compression.
+	Compressed      uint64
+	RawBytes        uint64
+	CompressedBytes uint64
+
+	// Entries that met the threshold but were stored raw because
+	// compression did not make them smaller.
+	Incompressible uint64
+
+	Decompressed uint64
+
+	CompressTime   time.Duration
+	DecompressTime time.Duration
+}
+
+// Ratio returns RawBytes/CompressedBytes, 0 before anything was compressed.
+func (s CompressionStats) Ratio() float64 {
+	if s.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.RawBytes) / float64(s.CompressedBytes)
+}
+
+type compressionStats struct {
+	compressed      atomic.Uint64
+	rawBytes        atomic.Uint64
+	compressedBytes atomic.Uint64
+	incompressible  atomic.Uint64
+	decompressed    atomic.Uint64
+	compressNanos   atomic.Int64
+	decompressNanos atomic.Int64
+}
+
+func (s *compressionStats) snapshot() CompressionStats {
+	return CompressionStats{
+		Compressed:      s.compressed.Load(),
+		RawBytes:        s.rawBytes.Load(),
+		CompressedBytes: s.compressedBytes.Load(),
+		Incompressible:  s.incompressible.Load(),
+		Decompressed:    s.decompressed.Load(),
+		CompressTime:    time.Duration(s.compressNanos.Load()),
+		DecompressTime:  time.Duration(s.decompressNanos.Load()),
+	}
+}
+
+// compress returns data compressed with the configured algorithm, or false
+// when that would not save any space.
+func (c *logCodec) compress(data []byte) ([]byte, bool) {
+	start := time.Now()
+
+	var out []byte
+	switch c.compression {
+	case CompressionSnappy:
+		out = snappy.Encode(nil, data)
+	case CompressionZstd:
+		out = zstdEncoder.EncodeAll(data, nil)
+	}
+
+	c.stats.compressNanos.Add(int64(time.Since(start)))
+
+	if len(out) == 0 || len(out) >= len(data) {
+		c.stats.incompressible.Inc()
+		return nil, false
+	}
+
+	c.stats.compressed.Inc()
+	c.stats.rawBytes.Add(uint64(len(data)))
+	c.stats.compressedBytes.Add(uint64(len(out)))
+
+	return out, true
+}
+
+func (c *logCodec) decompress(algo Compression, data []byte, rawLen uint64) ([]byte, error) {
+	start := time.Now()
+	defer func() {
+		c.stats.decompressNanos.Add(int64(time.Since(start)))
+	}()
+
+	var (
+		out []byte
+		err error
+	)
+
+	switch algo {
+	case CompressionSnappy:
+		if n, derr := snappy.DecodedLen(data); derr != nil || uint64(n) != rawLen {
+			return nil, errDecompressedSize
+		}
+		out, err = snappy.Decode(make([]byte, rawLen), data)
+	case CompressionZstd:
+		// rawLen is only a hint here, a corrupt one must not allocate
+		// unbounded memory; the length is checked below
+		out, err = zstdDecoder.DecodeAll(data, make([]byte, 0, min(rawLen, maxPreallocSize)))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(out)) != rawLen {
+		return nil, errDecompressedSize
+	}
+
+	c.stats.decompressed.Inc()
+
+	if len(out) == 0 {
+		return nil, nil
+	}
+
+	return out, nil
+}
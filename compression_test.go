@@ -0,0 +1,118 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestCodec_Compression(t *testing.T) {
+	large := []byte(strings.Repeat(`{"key":"value","counter":12345},`, 200))
+
+	for _, algo := range []Compression{CompressionSnappy, CompressionZstd} {
+		codec := &logCodec{
+			writer:      CodecBinary,
+			compression: algo,
+			threshold:   512,
+			stats:       &compressionStats{},
+		}
+
+		in := testFullRaftLog(1)
+		in.Data = large
+		buf := codec.encodeBinary(in)
+		if compressionFromFlags(buf[1]) != algo {
+			t.Fatalf("%s: expected compressed entry", algo)
+		}
+		if len(buf) >= len(large) {
+			t.Fatalf("%s: entry was not shrunk: %d", algo, len(buf))
+		}
+
+		out := new(raft.Log)
+		if err := codec.decode(in.Index, buf, out); err != nil {
+			t.Fatalf("%s: err: %s", algo, err)
+		}
+		if !bytes.Equal(out.Data, large) || out.Index != 1 || !out.AppendedAt.Equal(in.AppendedAt) {
+			t.Fatalf("%s: bad: %#v", algo, out)
+		}
+
+		// Below the threshold the data is stored raw
+		small := testRaftLog(2, "small")
+		if buf := codec.encodeBinary(small); compressionFromFlags(buf[1]) != CompressionNone {
+			t.Fatalf("%s: small entry should not be compressed", algo)
+		}
+
+		// Incompressible data is stored raw too
+		random := testRaftLog(3, "")
+		random.Data = randomBytes(4096)
+		if buf := codec.encodeBinary(random); compressionFromFlags(buf[1]) != CompressionNone {
+			t.Fatalf("%s: random entry should not be compressed", algo)
+		}
+
+		stats := codec.stats.snapshot()
+		if stats.Compressed != 1 || stats.Incompressible != 1 || stats.Decompressed != 1 {
+			t.Fatalf("%s: bad stats: %+v", algo, stats)
+		}
+		if stats.RawBytes != uint64(len(large)) || stats.Ratio() <= 1 {
+			t.Fatalf("%s: bad stats: %+v", algo, stats)
+		}
+
+		// A corrupt raw length is detected. It follows format, flags, index,
+		// term and type, which take one byte each here.
+		corrupt := codec.encodeBinary(in)
+		corrupt[5]++
+		if err := codec.decode(in.Index, corrupt, new(raft.Log)); err == nil {
+			t.Fatalf("%s: expected error decoding corrupt entry", algo)
+		}
+	}
+}
+
+func TestPebbleStore_Compression(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.LogCompression = CompressionZstd
+	cfg.LogCompressionThreshold = 64
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+
+	logs := []*raft.Log{
+		testRaftLog(1, strings.Repeat("a", 1000)),
+		testRaftLog(2, "short"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if stats := store.Engine().CompressionStats(); stats.Compressed != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+	store.Close()
+
+	// Compressed entries stay readable after compression is turned off
+	cfg.LogCompression = CompressionNone
+	store, err := NewPebbleStore(store.path, &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	for _, expected := range logs {
+		log := new(raft.Log)
+		if err := store.GetLog(expected.Index, log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(log, expected) {
+			t.Fatalf("bad: %#v", log)
+		}
+	}
+}
+
+func TestPebbleStore_CompressionRequiresBinary(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.LogCodec = CodecMsgpack
+	cfg.LogCompression = CompressionSnappy
+	if _, err := NewPebbleStore(t.TempDir(), &Logger{}, cfg); err == nil {
+		t.Fatalf("expected error")
+	}
+}
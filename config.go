@@ -1,5 +1,63 @@
 package raftpebbledb
 
+import (
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// DurabilityMode selects when writes are synced to disk.
+type DurabilityMode int
+
+const (
+	// SyncAlways syncs the WAL on every StoreLogs, DeleteRange, Set and
+	// SetUint64. This is the default.
+	SyncAlways DurabilityMode = iota
+
+	// SyncNever never syncs on write. Data reaches disk when pebble flushes
+	// memtables or when Sync or Close is called, so a crash may lose any
+	// write acknowledged since.
+	SyncNever
+
+	// SyncPeriodic writes without syncing and syncs the WAL in the
+	// background every SyncInterval.
+	SyncPeriodic
+
+	// SyncStableOnly syncs Set and SetUint64, which raft uses for the
+	// current term and vote, but not log writes.
+	SyncStableOnly
+)
+
+func (m DurabilityMode) String() string {
+	switch m {
+	case SyncAlways:
+		return "always"
+	case SyncNever:
+		return "never"
+	case SyncPeriodic:
+		return "periodic"
+	case SyncStableOnly:
+		return "stable-only"
+	}
+	return "unknown"
+}
+
+// writeOptions returns the pebble options for a log write or, when stable is
+// true, a stable store write.
+func (m DurabilityMode) writeOptions(stable bool) *pebble.WriteOptions {
+	switch m {
+	case SyncNever, SyncPeriodic:
+		return pebble.NoSync
+	case SyncStableOnly:
+		if stable {
+			return pebble.Sync
+		}
+		return pebble.NoSync
+	}
+	return pebble.Sync
+}
+
 type PebbleDBConfig struct {
 	KVLRUCacheSize                   int64
 	KVWriteBufferSize                uint64
@@ -16,6 +74,94 @@ type PebbleDBConfig struct {
 	KVMaxManifestFileSize            int64
 	KVBytesPerSync                   int
 	KVWALBytesPerSync                int
+
+	// Monotonic makes the store implement raft.MonotonicLogStore: StoreLogs
+	// rejects batches that would leave a gap or rewind the log.
+	Monotonic bool
+
+	// GroupCommitWindow enables group commit when non-zero: StoreLogs, Set
+	// and SetUint64 calls arriving within the window of each other share a
+	// single synced batch. Each caller still receives its own error and only
+	// returns once its writes are durable.
+	GroupCommitWindow time.Duration
+
+	// Durability controls which writes are synced. SyncInterval is the
+	// period of the background sync used by SyncPeriodic and must be
+	// positive in that mode.
+	Durability   DurabilityMode
+	SyncInterval time.Duration
+
+	// LogCodec is the encoding of newly stored log entries. Entries written
+	// with either codec can always be read back.
+	LogCodec LogCodec
+
+	// LogCompression compresses raft.Log.Data of at least
+	// LogCompressionThreshold bytes. Requires CodecBinary; entries are
+	// flagged individually, so it can be changed between restarts.
+	LogCompression          Compression
+	LogCompressionThreshold int
+
+	// KeyProvider enables encryption at rest: log entries and Set/SetUint64
+	// values are sealed with AES-GCM. ReencryptOnOpen starts a background
+	// pass moving values sealed with retired keys to the current one.
+	KeyProvider     KeyProvider
+	ReencryptOnOpen bool
+
+	// FS is the filesystem the db lives on, the OS filesystem when nil. Use
+	// vfs.NewMem for a store without disk, or vfs.NewStrictMem to simulate
+	// crashes that lose unsynced writes. See NewPebbleStoreInMemory.
+	FS vfs.FS
+
+	// ReadOnly opens the db without ever writing to it, for inspection
+	// tools and backup sidecars. No directory is created and every write
+	// returns ErrReadOnly. See NewPebbleStoreReadOnly.
+	ReadOnly bool
+
+	// LogCompactionThreshold starts a background compaction of the log
+	// ranges removed by DeleteRange once their estimated size on disk adds
+	// up to it, reclaiming the space and dropping the range tombstones reads
+	// would otherwise skip over. Zero leaves them to pebble's own
+	// compactions. PebbleStore.CompactLogs compacts them on demand.
+	LogCompactionThreshold uint64
+
+	// RetentionMaxBytes and RetentionMaxAge set a budget for the log of
+	// every store: the encoded size of its entries, and the age of the
+	// oldest by raft.Log.AppendedAt. Zero is no limit. Setting either one
+	// keeps a byte count of each log, read in full when the store opens.
+	// See PebbleStore.Retention.
+	RetentionMaxBytes uint64
+	RetentionMaxAge   time.Duration
+
+	// OnRetentionExceeded is called, on a goroutine of its own, when a write
+	// takes a store's log over budget, typically to take a raft snapshot so
+	// raft truncates the log. It is called again once the log has been back
+	// within budget.
+	OnRetentionExceeded func(store *PebbleStore, status RetentionStatus)
+
+	// ArchiveDir enables archive mode: before DeleteRange removes entries
+	// from the front of the log, which is how raft compacts it, they are
+	// written to checksummed segment files in this directory, each with an
+	// index file, and encrypted like the store. A standalone store archives
+	// to ArchiveDir itself and group N of an engine to ArchiveDir/group-N.
+	// ArchiveCompression compresses the segments. See OpenLogArchive.
+	ArchiveDir         string
+	ArchiveCompression Compression
+
+	// CloseTimeout bounds how long Close waits for calls already running,
+	// including open snapshot readers, before giving up with
+	// ErrCloseTimeout. Zero waits as long as it takes.
+	CloseTimeout time.Duration
+
+	// OnError is called by the default event listener for every error pebble
+	// reports. A background error (failed flush or compaction) also degrades
+	// the db to read-only, see PebbleEngine.Degraded.
+	OnError func(err error)
+
+	// EventListener, when set, is given the default listener and returns the
+	// one pebble uses. Return defaults wrapped with pebble.TeeEventListener
+	// to add hooks, or a different listener to replace it; a replacement
+	// does not degrade the db on background errors.
+	EventListener func(defaults pebble.EventListener) pebble.EventListener
 }
 
 func DefaultPebbleDBConfig() *PebbleDBConfig {
@@ -35,5 +181,13 @@ func DefaultPebbleDBConfig() *PebbleDBConfig {
 		KVMaxManifestFileSize:            128 * 1024 * 1024, // 128MB
 		KVBytesPerSync:                   2 * 1024 * 1024,   // 2MB
 		KVWALBytesPerSync:                2 * 1024 * 1024,   // 2MB
+		Durability:                       SyncAlways,
+		SyncInterval:                     100 * time.Millisecond,
+		LogCodec:                         CodecBinary,
+		LogCompression:                   CompressionNone,
+		LogCompressionThreshold:          1024,             // 1KB
+		LogCompactionThreshold:           64 * 1024 * 1024, // 64MB
+		ArchiveCompression:               CompressionZstd,
+		CloseTimeout:                     30 * time.Second,
 	}
 }
@@ -0,0 +1,297 @@
+package raftpebbledb
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+	"go.uber.org/atomic"
+)
+
+var crashSeed = flag.Int64("crash.seed", 0, "seed of TestPebbleStore_CrashConsistency, random when 0")
+
+// crashFS passes every call through to a strict MemFS until the crashAt-th
+// sync. From that sync on, syncs are ignored, so whatever is written after it
+// is lost when the test calls ResetToSyncedState: a power loss in the middle
+// of whatever the store was doing.
+type crashFS struct {
+	vfs.FS
+	mem     *vfs.MemFS
+	syncs   *atomic.Int64
+	crashAt int64
+	crashed *atomic.Bool
+}
+
+func newCrashFS(mem *vfs.MemFS, crashAt int64) *crashFS {
+	return &crashFS{
+		FS:      mem,
+		mem:     mem,
+		syncs:   atomic.NewInt64(0),
+		crashAt: crashAt,
+		crashed: atomic.NewBool(false),
+	}
+}
+
+// sync counts a sync and crashes on the crashAt-th. crashed is set before
+// syncs are ignored, so a write that returns while crashed is still false was
+// synced.
+func (fs *crashFS) sync() {
+	if fs.syncs.Inc() == fs.crashAt {
+		fs.crashed.Store(true)
+		fs.mem.SetIgnoreSyncs(true)
+	}
+}
+
+func (fs *crashFS) wrap(f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &crashFile{File: f, fs: fs}, nil
+}
+
+func (fs *crashFS) Create(name string) (vfs.File, error) {
+	return fs.wrap(fs.FS.Create(name))
+}
+
+func (fs *crashFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	return fs.wrap(fs.FS.Open(name, opts...))
+}
+
+func (fs *crashFS) OpenReadWrite(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	return fs.wrap(fs.FS.OpenReadWrite(name, opts...))
+}
+
+func (fs *crashFS) OpenDir(name string) (vfs.File, error) {
+	return fs.wrap(fs.FS.OpenDir(name))
+}
+
+func (fs *crashFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	return fs.wrap(fs.FS.ReuseForWrite(oldname, newname))
+}
+
+type crashFile struct {
+	vfs.File
+	fs *crashFS
+}
+
+func (f *crashFile) Sync() error {
+	f.fs.sync()
+	return f.File.Sync()
+}
+
+func (f *crashFile) SyncData() error {
+	f.fs.sync()
+	return f.File.SyncData()
+}
+
+func (f *crashFile) SyncTo(length int64) (bool, error) {
+	f.fs.sync()
+	return f.File.SyncTo(length)
+}
+
+// crashModel is the state the store must hold: its logs and Set keys.
+type crashModel struct {
+	logs map[uint64]string
+	conf map[string]string
+	next uint64
+}
+
+func (m *crashModel) clone() *crashModel {
+	c := &crashModel{logs: make(map[uint64]string), conf: make(map[string]string), next: m.next}
+	for k, v := range m.logs {
+		c.logs[k] = v
+	}
+	for k, v := range m.conf {
+		c.conf[k] = v
+	}
+	return c
+}
+
+func (m *crashModel) bounds() (uint64, uint64) {
+	var first, last uint64
+	for idx := range m.logs {
+		if first == 0 || idx < first {
+			first = idx
+		}
+		if idx > last {
+			last = idx
+		}
+	}
+	return first, last
+}
+
+// crashOp is a store write whose effect has already been applied to a model.
+type crashOp struct {
+	name string
+	run  func(store *PebbleStore) error
+}
+
+// randomCrashOp picks the next operation the way raft issues them: appends at
+// the end of the log, truncation of a prefix after a snapshot, truncation of
+// a conflicting suffix, and stable store updates.
+func randomCrashOp(rng *rand.Rand, m *crashModel) crashOp {
+	first, last := m.bounds()
+
+	switch n := rng.Intn(10); {
+	case n < 6 || last == 0:
+		count := 1 + rng.Intn(20)
+		start := m.next
+		logs := make([]*raft.Log, 0, count)
+		for i := 0; i < count; i++ {
+			data := fmt.Sprintf("%d-%s", start+uint64(i), strings.Repeat("x", rng.Intn(4096)))
+			logs = append(logs, &raft.Log{Index: start + uint64(i), Term: 1, Data: []byte(data)})
+			m.logs[start+uint64(i)] = data
+		}
+		m.next = start + uint64(count)
+		return crashOp{fmt.Sprintf("StoreLogs(%d-%d)", start, m.next-1), func(s *PebbleStore) error {
+			return s.StoreLogs(logs)
+		}}
+
+	case n < 8:
+		max := first + uint64(rng.Int63n(int64(last-first+1)))
+		for idx := first; idx <= max; idx++ {
+			delete(m.logs, idx)
+		}
+		return crashOp{fmt.Sprintf("DeleteRange(%d-%d)", first, max), func(s *PebbleStore) error {
+			return s.DeleteRange(first, max)
+		}}
+
+	case n < 9:
+		min := first + uint64(rng.Int63n(int64(last-first+1)))
+		for idx := min; idx <= last; idx++ {
+			delete(m.logs, idx)
+		}
+		m.next = min
+		return crashOp{fmt.Sprintf("DeleteRange(%d-%d)", min, last), func(s *PebbleStore) error {
+			return s.DeleteRange(min, last)
+		}}
+
+	default:
+		key := fmt.Sprintf("key%d", rng.Intn(4))
+		val := fmt.Sprintf("val%d", rng.Int())
+		m.conf[key] = val
+		return crashOp{fmt.Sprintf("Set(%s)", key), func(s *PebbleStore) error {
+			return s.Set([]byte(key), []byte(val))
+		}}
+	}
+}
+
+// readCrashState reads back what a recovered store holds, checking the
+// invariants that hold whatever was lost.
+func readCrashState(t *testing.T, store *PebbleStore) *crashModel {
+	first, _ := store.FirstIndex()
+	last, _ := store.LastIndex()
+	if first > last || (first == 0) != (last == 0) {
+		t.Fatalf("bad bounds: first %d, last %d", first, last)
+	}
+
+	state := &crashModel{logs: make(map[uint64]string), conf: make(map[string]string)}
+	for idx := first; idx <= last && last != 0; idx++ {
+		log := new(raft.Log)
+		if err := store.GetLog(idx, log); err != nil {
+			t.Fatalf("log %d of %d-%d: %s", idx, first, last, err)
+		}
+		state.logs[idx] = string(log.Data)
+	}
+
+	err := store.ForEach(func(key, val []byte) error {
+		state.conf[string(key)] = string(val)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return state
+}
+
+func sameCrashState(a, b *crashModel) bool {
+	return reflect.DeepEqual(a.logs, b.logs) && reflect.DeepEqual(a.conf, b.conf)
+}
+
+// TestPebbleStore_CrashConsistency runs random raft-like writes on a strict
+// in-memory filesystem, cuts the power at a random sync and checks that the
+// reopened store holds every acknowledged write, and of the write in flight
+// at the crash either all or nothing.
+func TestPebbleStore_CrashConsistency(t *testing.T) {
+	seed := *crashSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed %d, rerun with -crash.seed=%d", seed, seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	rounds, ops := 40, 300
+	if testing.Short() {
+		rounds = 5
+	}
+
+	for round := 0; round < rounds; round++ {
+		mem := vfs.NewStrictMem()
+		fs := newCrashFS(mem, 1+rng.Int63n(int64(ops)))
+
+		cfg := DefaultPebbleDBConfig()
+		cfg.FS = fs
+		cfg.KVWriteBufferSize = 256 * 1024 // flush and compact often
+		if rng.Intn(2) == 0 {
+			cfg.GroupCommitWindow = time.Millisecond
+		}
+
+		store, err := NewPebbleStoreInMemory(&Logger{}, cfg)
+		if err != nil {
+			t.Fatalf("round %d: %s", round, err)
+		}
+
+		acked := &crashModel{logs: make(map[uint64]string), conf: make(map[string]string), next: 1}
+		inflight := acked
+		var history []string
+
+		for i := 0; i < ops && !fs.crashed.Load(); i++ {
+			inflight = acked.clone()
+			op := randomCrashOp(rng, inflight)
+			history = append(history, op.name)
+
+			if err := op.run(store); err != nil {
+				t.Fatalf("round %d: %s: %s", round, op.name, err)
+			}
+
+			if !fs.crashed.Load() {
+				acked = inflight
+			}
+		}
+
+		// Crash if no sync reached crashAt, then drop everything unsynced
+		fs.crashed.Store(true)
+		mem.SetIgnoreSyncs(true)
+		store.Close()
+		mem.ResetToSyncedState()
+		mem.SetIgnoreSyncs(false)
+
+		cfg.FS = mem
+		store, err = NewPebbleStoreInMemory(&Logger{}, cfg)
+		if err != nil {
+			t.Fatalf("round %d: reopen: %s", round, err)
+		}
+
+		state := readCrashState(t, store)
+		if !sameCrashState(state, acked) && !sameCrashState(state, inflight) {
+			first, last := state.bounds()
+			wantFirst, wantLast := acked.bounds()
+			t.Fatalf("round %d: recovered logs %d-%d, acknowledged %d-%d after %v",
+				round, first, last, wantFirst, wantLast, history[max(0, len(history)-5):])
+		}
+
+		// The recovered store keeps working
+		_, last := state.bounds()
+		if err := store.StoreLogs([]*raft.Log{{Index: last + 1, Term: 2}}); err != nil {
+			t.Fatalf("round %d: %s", round, err)
+		}
+		store.Close()
+	}
+}
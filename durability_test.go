@@ -0,0 +1,205 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+)
+
+func TestDurabilityMode_WriteOptions(t *testing.T) {
+	cases := []struct {
+		mode   DurabilityMode
+		log    bool
+		stable bool
+	}{
+		{SyncAlways, true, true},
+		{SyncNever, false, false},
+		{SyncPeriodic, false, false},
+		{SyncStableOnly, false, true},
+	}
+	for _, c := range cases {
+		if got := c.mode.writeOptions(false).Sync; got != c.log {
+			t.Fatalf("%s: bad log sync: %v", c.mode, got)
+		}
+		if got := c.mode.writeOptions(true).Sync; got != c.stable {
+			t.Fatalf("%s: bad stable sync: %v", c.mode, got)
+		}
+	}
+}
+
+func TestPebbleStore_DurabilityModes(t *testing.T) {
+	modes := []DurabilityMode{SyncAlways, SyncNever, SyncPeriodic, SyncStableOnly}
+	for _, mode := range modes {
+		for _, window := range []time.Duration{0, time.Millisecond} {
+			cfg := DefaultPebbleDBConfig()
+			cfg.Durability = mode
+			cfg.SyncInterval = 5 * time.Millisecond
+			cfg.GroupCommitWindow = window
+
+			store := testPebbleStoreWithConfig(t, cfg)
+			path := store.path
+
+			logs := []*raft.Log{
+				testRaftLog(1, "log1"),
+				testRaftLog(2, "log2"),
+				testRaftLog(3, "log3"),
+			}
+			if err := store.StoreLogs(logs); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+			if err := store.DeleteRange(1, 1); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+			if err := store.Set([]byte("hello"), []byte("world")); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+			if err := store.SetUint64([]byte("term"), 7); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+			if err := store.Sync(); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+			if err := store.Sync(); err != pebble.ErrClosed {
+				t.Fatalf("%s: expected closed error, got: %v", mode, err)
+			}
+
+			// Everything acknowledged before Close survives a reopen
+			store, err := NewPebbleStore(path, &Logger{}, cfg)
+			if err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+
+			first, _ := store.FirstIndex()
+			last, _ := store.LastIndex()
+			if first != 2 || last != 3 {
+				t.Fatalf("%s: bad indexes: %d %d", mode, first, last)
+			}
+			if err := store.GetLog(1, new(raft.Log)); err != raft.ErrLogNotFound {
+				t.Fatalf("%s: should have deleted log1", mode)
+			}
+			val, err := store.Get([]byte("hello"))
+			if err != nil || !bytes.Equal(val, []byte("world")) {
+				t.Fatalf("%s: bad: %q %v", mode, val, err)
+			}
+			term, err := store.GetUint64([]byte("term"))
+			if err != nil || term != 7 {
+				t.Fatalf("%s: bad: %d %v", mode, term, err)
+			}
+
+			store.Close()
+			os.RemoveAll(path)
+		}
+	}
+}
+
+func TestPebbleStore_DurabilityCrash(t *testing.T) {
+	for _, mode := range []DurabilityMode{SyncAlways, SyncStableOnly, SyncPeriodic} {
+		for _, window := range []time.Duration{0, time.Millisecond} {
+			mem := vfs.NewStrictMem()
+
+			cfg := DefaultPebbleDBConfig()
+			cfg.FS = mem
+			cfg.Durability = mode
+			cfg.SyncInterval = time.Millisecond
+			cfg.GroupCommitWindow = window
+
+			// Every acknowledged log write survives unless only the stable
+			// store is synced
+			logsSynced := mode != SyncStableOnly
+
+			store, err := NewPebbleStoreInMemory(&Logger{}, cfg)
+			if err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+
+			logs := []*raft.Log{
+				testRaftLog(1, "log1"),
+				testRaftLog(2, "log2"),
+				testRaftLog(3, "log3"),
+			}
+			if err := store.StoreLogs(logs); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+			if err := store.Set([]byte("hello"), []byte("world")); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+			if err := store.SetUint64([]byte("term"), 7); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+			if logsSynced {
+				if err := store.DeleteRange(1, 1); err != nil {
+					t.Fatalf("%s: err: %s", mode, err)
+				}
+				if err := store.StoreLogs([]*raft.Log{testRaftLog(4, "log4")}); err != nil {
+					t.Fatalf("%s: err: %s", mode, err)
+				}
+			}
+
+			// Nothing above was synced by the writes themselves, the
+			// background syncer makes them durable within the interval
+			if mode == SyncPeriodic {
+				time.Sleep(100 * cfg.SyncInterval)
+			}
+
+			// Crash: nothing written from here on reaches the disk
+			mem.SetIgnoreSyncs(true)
+			store.Close()
+			mem.ResetToSyncedState()
+			mem.SetIgnoreSyncs(false)
+
+			store, err = NewPebbleStoreInMemory(&Logger{}, cfg)
+			if err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+
+			// Every acknowledged stable store write survives
+			val, err := store.Get([]byte("hello"))
+			if err != nil || !bytes.Equal(val, []byte("world")) {
+				t.Fatalf("%s: bad: %q %v", mode, val, err)
+			}
+			term, err := store.GetUint64([]byte("term"))
+			if err != nil || term != 7 {
+				t.Fatalf("%s: bad: %d %v", mode, term, err)
+			}
+
+			// And every acknowledged log write when logs are synced
+			if logsSynced {
+				first, _ := store.FirstIndex()
+				last, _ := store.LastIndex()
+				if first != 2 || last != 4 {
+					t.Fatalf("%s: bad indexes: %d %d", mode, first, last)
+				}
+				for i := uint64(2); i <= 4; i++ {
+					log := new(raft.Log)
+					if err := store.GetLog(i, log); err != nil {
+						t.Fatalf("%s: err: %s", mode, err)
+					}
+					if string(log.Data) != fmt.Sprintf("log%d", i) {
+						t.Fatalf("%s: bad: %#v", mode, log)
+					}
+				}
+			}
+
+			store.Close()
+		}
+	}
+}
+
+func TestPebbleStore_SyncPeriodicInterval(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.Durability = SyncPeriodic
+	cfg.SyncInterval = 0
+
+	if _, err := NewPebbleStoreInMemory(&Logger{}, cfg); err == nil {
+		t.Fatalf("expected error for a periodic sync without interval")
+	}
+}
@@ -0,0 +1,494 @@
+package raftpebbledb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// valueFormatEncrypted is the leading byte of a value sealed with AES-GCM:
+//
+//	format(1) len(keyID)(1) keyID nonce(12) ciphertext+tag
+//
+// The pebble key is the additional authenticated data, so a value copied
+// under another key fails to open. Log values wrap the checksummed entry.
+const valueFormatEncrypted byte = 0x03
+
+var (
+	// ErrNoKeyProvider is returned when an encrypted value is read from a
+	// store opened without PebbleDBConfig.KeyProvider.
+	ErrNoKeyProvider = errors.New("value is encrypted but no key provider is configured")
+
+	errCorruptEncrypted = errors.New("corrupt encrypted value")
+)
+
+// KeyProvider supplies AES keys (16, 24 or 32 bytes) for encryption at rest.
+// Every value records the ID of the key that sealed it, so rotating the
+// current key keeps older values readable as long as Key still returns the
+// retired keys; PebbleEngine.Reencrypt moves them to the current key.
+type KeyProvider interface {
+	// CurrentKey returns the key new values are sealed with. It is called
+	// once per write, a whole StoreLogs batch being one write, so a provider
+	// backed by a KMS should cache the key rather than fetch it every time.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+type callbackKeyProvider struct {
+	current func() (string, []byte, error)
+	lookup  func(id string) ([]byte, error)
+}
+
+// NewCallbackKeyProvider returns a KeyProvider backed by the two callbacks,
+// for keys held by a KMS or secret manager.
+func NewCallbackKeyProvider(current func() (string, []byte, error), lookup func(id string) ([]byte, error)) KeyProvider {
+	return &callbackKeyProvider{current: current, lookup: lookup}
+}
+
+func (p *callbackKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current()
+}
+
+func (p *callbackKeyProvider) Key(id string) ([]byte, error) {
+	return p.lookup(id)
+}
+
+type staticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewStaticKeyProvider loads keys from a file holding one "<id> <hex key>"
+// pair per line. The first key is current, the others are retired keys kept
+// to read older values. Blank lines and lines starting with # are ignored.
+func NewStaticKeyProvider(path string) (KeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseStaticKeys(f)
+}
+
+func parseStaticKeys(r io.Reader) (*staticKeyProvider, error) {
+	p := &staticKeyProvider{keys: make(map[string][]byte)}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			return nil, fmt.Errorf("key file line %d: expected \"<id> <hex key>\"", line)
+		}
+
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d: %w", line, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("key file line %d: %w", line, err)
+		}
+
+		if p.current == "" {
+			p.current = fields[0]
+		}
+		p.keys[fields[0]] = key
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if p.current == "" {
+		return nil, errors.New("key file holds no keys")
+	}
+
+	return p, nil
+}
+
+func (p *staticKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *staticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	return key, nil
+}
+
+// valueCipher seals and opens values with keys from a KeyProvider. The AEAD
+// of each key is built once; the provider is asked for the current key on
+// every write so rotation takes effect without a restart.
+type valueCipher struct {
+	provider KeyProvider
+	aeads    sync.Map // key id -> cipher.AEAD
+}
+
+func newValueCipher(provider KeyProvider) *valueCipher {
+	if provider == nil {
+		return nil
+	}
+	return &valueCipher{provider: provider}
+}
+
+func (c *valueCipher) aead(id string, key []byte) (cipher.AEAD, error) {
+	if aead, ok := c.aeads.Load(id); ok {
+		return aead.(cipher.AEAD), nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c.aeads.Store(id, aead)
+
+	return aead, nil
+}
+
+// sealer seals values with the current key as resolved once by
+// valueCipher.sealer. A nil sealer leaves values in plaintext.
+type sealer struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// sealer asks the provider for the current key. Writers sealing many values
+// at once resolve it once for the whole batch.
+func (c *valueCipher) sealer() (*sealer, error) {
+	id, secret, err := c.provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("encryption key id %q is longer than 255 bytes", id)
+	}
+
+	aead, err := c.aead(id, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealer{id: id, aead: aead}, nil
+}
+
+// seal encrypts val for storage under key with the current key.
+func (c *valueCipher) seal(key, val []byte) ([]byte, error) {
+	s, err := c.sealer()
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(key, val)
+}
+
+// seal encrypts val for storage under key.
+func (s *sealer) seal(key, val []byte) ([]byte, error) {
+	if s == nil {
+		return val, nil
+	}
+
+	header := 2 + len(s.id) + s.aead.NonceSize()
+	buf := make([]byte, header, header+len(val)+s.aead.Overhead())
+	buf[0] = valueFormatEncrypted
+	buf[1] = byte(len(s.id))
+	copy(buf[2:], s.id)
+
+	nonce := buf[2+len(s.id) : header]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return s.aead.Seal(buf, nonce, val, key), nil
+}
+
+// open decrypts a value sealed by seal and returns the plaintext and the ID
+// of the key that sealed it.
+func (c *valueCipher) open(key, val []byte) ([]byte, string, error) {
+	if len(val) < 2 || val[0] != valueFormatEncrypted {
+		return nil, "", errCorruptEncrypted
+	}
+
+	idLen := int(val[1])
+	if len(val) < 2+idLen {
+		return nil, "", errCorruptEncrypted
+	}
+	id := string(val[2 : 2+idLen])
+
+	secret, err := c.provider.Key(id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	aead, err := c.aead(id, secret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rest := val[2+idLen:]
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, "", errCorruptEncrypted
+	}
+
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], key)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errCorruptEncrypted, err)
+	}
+
+	return plain, id, nil
+}
+
+// sealValue encrypts val when the engine has a key provider.
+func (e *PebbleEngine) sealValue(key, val []byte) ([]byte, error) {
+	if e.cipher == nil {
+		return val, nil
+	}
+	return e.cipher.seal(key, val)
+}
+
+// sealer returns the sealer for a batch of values, nil when the engine has no
+// key provider.
+func (e *PebbleEngine) sealer() (*sealer, error) {
+	if e.cipher == nil {
+		return nil, nil
+	}
+	return e.cipher.sealer()
+}
+
+// openLogValue returns the plaintext of a stored log value. Log values are
+// never plaintext with a leading valueFormatEncrypted byte, so anything else
+// is passed through to the codec.
+func (e *PebbleEngine) openLogValue(index uint64, key, val []byte) ([]byte, error) {
+	if len(val) == 0 || val[0] != valueFormatEncrypted {
+		return val, nil
+	}
+
+	if e.cipher == nil {
+		return nil, ErrNoKeyProvider
+	}
+
+	plain, _, err := e.cipher.open(key, val)
+	if err != nil {
+		return nil, &CorruptLogError{Index: index, Err: err}
+	}
+
+	return plain, nil
+}
+
+// openStableValue returns the plaintext of a stored Set/SetUint64 value.
+// Values written before encryption was enabled are returned as they are,
+// except that a plaintext value starting with valueFormatEncrypted cannot be
+// told apart from a sealed one. Raft's own keys never do.
+func (e *PebbleEngine) openStableValue(key, val []byte) ([]byte, error) {
+	if e.cipher == nil || len(val) == 0 || val[0] != valueFormatEncrypted {
+		return val, nil
+	}
+
+	plain, _, err := e.cipher.open(key, val)
+	return plain, err
+}
+
+// runReencrypt runs Reencrypt in the background until it finishes or the
+// engine is closed.
+func (e *PebbleEngine) runReencrypt() {
+	defer e.bg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-e.stopc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	n, err := e.Reencrypt(ctx)
+	if err != nil && ctx.Err() == nil {
+		e.logger.Infof("pebbledb reencrypt error after %d values: %s\n", n, err.Error())
+		return
+	}
+
+	e.logger.Infof("pebbledb reencrypted %d values\n", n)
+}
+
+// isSnapshotKey reports whether key belongs to the __snaps__ bucket of a
+// standalone store or of any group.
+func isSnapshotKey(key []byte) bool {
+	if bytes.HasPrefix(key, groupPrefix) && len(key) >= len(groupPrefix)+8 {
+		key = key[len(groupPrefix)+8:]
+	}
+	return bytes.HasPrefix(key, dbSnaps)
+}
+
+// logsPrefixOf returns the logs prefix of the store key belongs to, nil when
+// key is not a log entry.
+func logsPrefixOf(key []byte) []byte {
+	n := 0
+	if bytes.HasPrefix(key, groupPrefix) && len(key) >= len(groupPrefix)+8 {
+		n = len(groupPrefix) + 8
+	}
+	if !bytes.HasPrefix(key[n:], dbLogs) {
+		return nil
+	}
+	return key[:n+len(dbLogs)]
+}
+
+// reencryptBatchSize bounds how many values Reencrypt rewrites while holding
+// the write lock.
+const reencryptBatchSize = 256
+
+// Reencrypt rewrites every value sealed with a key other than the current
+// one, across all groups, and returns how many it rewrote. It works in small
+// batches under the write lock, so it can run in the background while the
+// engine serves raft; cancel ctx to stop it early.
+func (e *PebbleEngine) Reencrypt(ctx context.Context) (int, error) {
+	if e.cipher == nil {
+		return 0, ErrNoKeyProvider
+	}
+
+	var (
+		cursor    []byte
+		rewritten int
+	)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+		// Each batch is a call of its own, so Close only waits for one
+		if !e.ops.acquire() {
+			return rewritten, pebble.ErrClosed
+		}
+		n, next, err := e.reencryptBatch(cursor)
+		e.ops.release()
+
+		rewritten += n
+		if err != nil || next == nil {
+			return rewritten, err
+		}
+		cursor = next
+	}
+}
+
+// reencryptBatch rotates up to reencryptBatchSize values at or after cursor
+// and returns the key to resume from, nil when the scan is complete.
+func (e *PebbleEngine) reencryptBatch(cursor []byte) (int, []byte, error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	if err := e.writable(); err != nil {
+		return 0, nil, err
+	}
+
+	current, err := e.cipher.sealer()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	iter, err := e.db.NewIter(&pebble.IterOptions{LowerBound: cursor})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer iter.Close()
+
+	batch := e.db.NewBatch()
+	defer batch.Close()
+
+	var (
+		seen int
+		next []byte
+
+		// The encoded size of the log entries rewritten, before and after,
+		// by logs prefix
+		resized = make(map[string][2]uint64)
+	)
+
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if seen == reencryptBatchSize {
+			next = append([]byte{}, iter.Key()...)
+			break
+		}
+		seen++
+
+		// Snapshot chunks are only encrypted as flagged by their metadata
+		if isSnapshotKey(iter.Key()) {
+			continue
+		}
+
+		val := iter.Value()
+		if len(val) == 0 || val[0] != valueFormatEncrypted {
+			continue
+		}
+
+		plain, id, err := e.cipher.open(iter.Key(), val)
+		if err != nil {
+			return 0, nil, fmt.Errorf("reencrypt %q: %w", iter.Key(), err)
+		}
+		if id == current.id {
+			continue
+		}
+
+		sealed, err := current.seal(iter.Key(), plain)
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := batch.Set(iter.Key(), sealed, nil); err != nil {
+			return 0, nil, err
+		}
+
+		if prefix := logsPrefixOf(iter.Key()); prefix != nil {
+			sizes := resized[string(prefix)]
+			sizes[0] += uint64(len(val))
+			sizes[1] += uint64(len(sealed))
+			resized[string(prefix)] = sizes
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return 0, nil, err
+	}
+
+	n := int(batch.Count())
+	if n == 0 {
+		return 0, next, nil
+	}
+
+	if err := batch.Commit(e.durability.writeOptions(true)); err != nil {
+		return 0, nil, err
+	}
+
+	for prefix, sizes := range resized {
+		if t := e.trackers[prefix]; t != nil {
+			t.add(0, sizes[1], 0, sizes[0])
+		}
+	}
+
+	return n, next, nil
+}
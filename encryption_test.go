@@ -0,0 +1,238 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	testKeyA = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	testKeyB = "f0e0d0c0b0a090807060504030201000f0e0d0c0b0a090807060504030201000"
+)
+
+func testKeyProvider(t *testing.T, lines ...string) KeyProvider {
+	p, err := parseStaticKeys(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return p
+}
+
+func TestStaticKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# keys\n\nb "+testKeyB+"\na "+testKeyA+"\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	p, err := NewStaticKeyProvider(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if id, _, _ := p.CurrentKey(); id != "b" {
+		t.Fatalf("bad: %s", id)
+	}
+	if _, err := p.Key("a"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := p.Key("c"); err == nil {
+		t.Fatalf("expected error for unknown key")
+	}
+
+	for _, bad := range []string{"", "a", "a zz", "a 0011"} {
+		if _, err := parseStaticKeys(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestPebbleStore_Encryption(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.KeyProvider = testKeyProvider(t, "a "+testKeyA)
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "secret1"), testRaftLog(2, "secret2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("k"), []byte("secret3")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64([]byte("n"), 42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Nothing is stored in the clear
+	iter, err := store.db.NewIter(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		if iter.Value()[0] != valueFormatEncrypted || bytes.Contains(iter.Value(), []byte("secret")) {
+			t.Fatalf("value of %q is not encrypted", iter.Key())
+		}
+	}
+	iter.Close()
+
+	log := new(raft.Log)
+	if err := store.GetLog(2, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, testRaftLog(2, "secret2")) {
+		t.Fatalf("bad: %#v", log)
+	}
+	if logs, err := store.GetLogs(1, 2, 0); err != nil || len(logs) != 2 {
+		t.Fatalf("bad: %v %v", logs, err)
+	}
+	if val, err := store.Get([]byte("k")); err != nil || string(val) != "secret3" {
+		t.Fatalf("bad: %q %v", val, err)
+	}
+	if val, err := store.GetUint64([]byte("n")); err != nil || val != 42 {
+		t.Fatalf("bad: %d %v", val, err)
+	}
+
+	// A sealed value moved under another key fails authentication
+	val, _ := store.getBytes(store.buildKey(store.logsPrefix, uint64ToBytes(1)))
+	if err := store.db.Set(store.buildKey(store.logsPrefix, uint64ToBytes(2)), val, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.GetLog(2, log); !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("expected corrupt log error, got: %v", err)
+	}
+}
+
+func TestPebbleStore_EncryptionCurrentKeyPerBatch(t *testing.T) {
+	keys := testKeyProvider(t, "a "+testKeyA)
+
+	var calls int
+	provider := NewCallbackKeyProvider(func() (string, []byte, error) {
+		calls++
+		return keys.CurrentKey()
+	}, keys.Key)
+
+	cfg := DefaultPebbleDBConfig()
+	cfg.KeyProvider = provider
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 100; i++ {
+		logs = append(logs, testRaftLog(i, "secret"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if calls != 1 {
+		t.Fatalf("bad: %d calls", calls)
+	}
+}
+
+func TestPebbleStore_EncryptionLegacyValues(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64([]byte("n"), 7); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	cfg := DefaultPebbleDBConfig()
+	cfg.KeyProvider = testKeyProvider(t, "a "+testKeyA)
+	store, err := NewPebbleStore(store.path, &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := store.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if val, err := store.Get([]byte("k")); err != nil || string(val) != "v" {
+		t.Fatalf("bad: %q %v", val, err)
+	}
+	if val, err := store.GetUint64([]byte("n")); err != nil || val != 7 {
+		t.Fatalf("bad: %d %v", val, err)
+	}
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	// Encrypted entries need the key provider
+	store, err = NewPebbleStore(store.path, &Logger{}, DefaultPebbleDBConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.GetLog(2, new(raft.Log)); !errors.Is(err, ErrNoKeyProvider) {
+		t.Fatalf("expected no key provider error, got: %v", err)
+	}
+}
+
+func TestPebbleEngine_Reencrypt(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.KeyProvider = testKeyProvider(t, "a "+testKeyA)
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 2*reencryptBatchSize+10; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64([]byte("n"), 7); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	// Rotate to key b, keeping a to read older values
+	cfg.KeyProvider = testKeyProvider(t, "b "+testKeyB, "a "+testKeyA)
+	store, err := NewPebbleStore(store.path, &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	n, err := store.Engine().Reencrypt(context.Background())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n != len(logs)+1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	if n, err := store.Engine().Reencrypt(context.Background()); err != nil || n != 0 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+
+	// Key a is no longer needed
+	store.engine.cipher = newValueCipher(testKeyProvider(t, "b "+testKeyB))
+
+	if err := store.GetLog(uint64(len(logs)), new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if val, err := store.GetUint64([]byte("n")); err != nil || val != 7 {
+		t.Fatalf("bad: %d %v", val, err)
+	}
+}
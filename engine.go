@@ -0,0 +1,408 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// groupPrefix namespaces the keys of every raft group hosted by a
+// PebbleEngine. A group's buckets live under groupPrefix + groupID, so they
+// never collide with each other or with the unprefixed buckets of a
+// standalone PebbleStore.
+var groupPrefix = []byte("__group__")
+
+// PebbleEngine owns a single pebble.DB shared by many raft groups. Every group
+// gets its own PebbleStore view whose keys are prefixed by the group ID, while
+// the cache, WAL, compactions, group commit and durability policy are shared.
+type PebbleEngine struct {
+	path   string
+	logger pebble.Logger
+	fs     vfs.FS
+	db     *pebble.DB
+	events *eventListener
+
+	readOnly   bool
+	monotonic  bool
+	durability DurabilityMode
+	codec      *logCodec
+	cipher     *valueCipher
+	compactor  *logCompactor
+	retention  retentionPolicy
+
+	// archiveDir is ArchiveDir, empty when archive mode is off
+	archiveDir         string
+	archiveCompression Compression
+
+	// commitc feeds the group committer when GroupCommitWindow is set and
+	// is nil otherwise. stopc is closed by Close to stop the background
+	// goroutines tracked by bg.
+	commitc chan *commitRequest
+	stopc   chan struct{}
+	bg      sync.WaitGroup
+
+	// writeMu serializes commits and range deletions so each store's cached
+	// indexes move in the same order as the db.
+	writeMu sync.Mutex
+
+	// trackers holds the retention tracker of every store that counted its
+	// log, by logs prefix, so Reencrypt can account for the values it
+	// rewrites. Guarded by writeMu.
+	trackers map[string]*retentionTracker
+
+	mu     sync.Mutex
+	stores map[uint64]*PebbleStore
+
+	// latency is set once a Collector is attached
+	latency *atomic.Pointer[prometheus.HistogramVec]
+
+	// ops counts the calls using db so Close can wait for them. closeMu
+	// serializes Close; closeDone is set once db is closed.
+	ops          *opTracker
+	closeTimeout time.Duration
+	closeMu      sync.Mutex
+	closeDone    bool
+
+	closed *atomic.Bool
+}
+
+func NewPebbleEngine(path string, logger pebble.Logger, cfg *PebbleDBConfig) (*PebbleEngine, error) {
+	if cfg == nil {
+		cfg = DefaultPebbleDBConfig()
+	}
+
+	e, err := newPebbleEngine(path, logger, cfg)
+	if err != nil {
+		return nil, err
+	}
+	e.startReencrypt(cfg)
+
+	return e, nil
+}
+
+// newPebbleEngine opens the engine without starting ReencryptOnOpen, so
+// NewPebbleStore can count its log first.
+func newPebbleEngine(path string, logger pebble.Logger, cfg *PebbleDBConfig) (*PebbleEngine, error) {
+
+	if cfg.Durability == SyncPeriodic && cfg.SyncInterval <= 0 {
+		return nil, fmt.Errorf("durability %s requires a positive sync interval", cfg.Durability)
+	}
+
+	codec, err := newLogCodec(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	events := newEventListener(logger, cfg.OnError)
+
+	db, err := openPebbleDB(cfg, path, logger, events)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := cfg.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+
+	e := &PebbleEngine{
+		path:       path,
+		logger:     logger,
+		fs:         fs,
+		db:         db,
+		events:     events,
+		readOnly:   cfg.ReadOnly,
+		monotonic:  cfg.Monotonic,
+		durability: cfg.Durability,
+		codec:      codec,
+		cipher:     newValueCipher(cfg.KeyProvider),
+		compactor:  newLogCompactor(cfg.LogCompactionThreshold),
+		retention: retentionPolicy{
+			maxBytes: cfg.RetentionMaxBytes,
+			maxAge:   cfg.RetentionMaxAge,
+			hook:     cfg.OnRetentionExceeded,
+		},
+		archiveDir:         cfg.ArchiveDir,
+		archiveCompression: cfg.ArchiveCompression,
+		stopc:              make(chan struct{}),
+		trackers:           make(map[string]*retentionTracker),
+		stores:             make(map[uint64]*PebbleStore),
+		latency:            atomic.NewPointer[prometheus.HistogramVec](nil),
+		ops:                newOpTracker(),
+		closed:             atomic.NewBool(false),
+
+		closeTimeout: cfg.CloseTimeout,
+	}
+
+	if cfg.ReadOnly {
+		return e, nil
+	}
+
+	if cfg.GroupCommitWindow > 0 {
+		e.commitc = make(chan *commitRequest)
+		e.bg.Add(1)
+		go e.runCommitter(cfg.GroupCommitWindow)
+	}
+
+	if cfg.Durability == SyncPeriodic {
+		e.bg.Add(1)
+		go e.runSyncer(cfg.SyncInterval)
+	}
+
+	if cfg.LogCompactionThreshold > 0 {
+		e.bg.Add(1)
+		go e.runCompactor()
+	}
+
+	return e, nil
+}
+
+// startReencrypt starts the background Reencrypt of ReencryptOnOpen.
+func (e *PebbleEngine) startReencrypt(cfg *PebbleDBConfig) {
+	if e.readOnly || e.cipher == nil || !cfg.ReencryptOnOpen {
+		return
+	}
+
+	e.bg.Add(1)
+	go e.runReencrypt()
+}
+
+// Store returns the LogStore/StableStore view of a raft group. Calling it
+// again for an open group returns the same view. Closing a view does not
+// close the engine.
+func (e *PebbleEngine) Store(groupID uint64) (*PebbleStore, error) {
+	if !e.ops.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer e.ops.release()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ps, ok := e.stores[groupID]; ok && !ps.isclosed() {
+		return ps, nil
+	}
+
+	ps, err := newPebbleStore(e, append(append([]byte{}, groupPrefix...), uint64ToBytes(groupID)...))
+	if err != nil {
+		return nil, err
+	}
+
+	e.stores[groupID] = ps
+
+	return ps, nil
+}
+
+// CompressionStats reports log payload compression since the engine opened.
+func (e *PebbleEngine) CompressionStats() CompressionStats {
+	return e.codec.stats.snapshot()
+}
+
+// Groups returns the IDs of the raft groups that have data in the engine, in
+// ascending order. Stores opened with NewPebbleStore are not groups.
+func (e *PebbleEngine) Groups() ([]uint64, error) {
+	if !e.ops.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer e.ops.release()
+
+	iter, err := e.db.NewIter(&pebble.IterOptions{
+		LowerBound: groupPrefix,
+		UpperBound: prefixUpperBound(groupPrefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var groups []uint64
+	for valid := iter.First(); valid; {
+		key := iter.Key()
+		if len(key) < len(groupPrefix)+8 {
+			valid = iter.Next()
+			continue
+		}
+
+		id := key[len(groupPrefix) : len(groupPrefix)+8]
+		groups = append(groups, bytesToUint64(id))
+
+		// Skip the rest of this group
+		valid = iter.SeekGE(prefixUpperBound(key[:len(groupPrefix)+8]))
+	}
+
+	return groups, iter.Error()
+}
+
+// Metrics returns pebble's metrics of the engine's db, whose String method
+// renders the per-level summary.
+func (e *PebbleEngine) Metrics() (*pebble.Metrics, error) {
+	if !e.ops.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer e.ops.release()
+
+	return e.db.Metrics(), nil
+}
+
+// Degraded returns nil while the engine accepts writes. After pebble reports a
+// background error it returns an error wrapping ErrDegraded and that cause;
+// reads keep working but every write fails until the db is reopened.
+func (e *PebbleEngine) Degraded() error {
+	return e.events.writable()
+}
+
+// writable returns ErrReadOnly for a read-only engine, the degraded error
+// after a background error, and nil otherwise. Every write checks it first.
+func (e *PebbleEngine) writable() error {
+	if e.readOnly {
+		return ErrReadOnly
+	}
+	return e.events.writable()
+}
+
+// ReadOnly reports whether the engine was opened read-only.
+func (e *PebbleEngine) ReadOnly() bool {
+	return e.readOnly
+}
+
+// Sync forces a durable barrier for every group: all writes acknowledged
+// before it returns are on disk regardless of the durability mode.
+func (e *PebbleEngine) Sync() error {
+	if !e.ops.acquire() {
+		return pebble.ErrClosed
+	}
+	defer e.ops.release()
+
+	if e.readOnly {
+		return ErrReadOnly
+	}
+
+	return e.db.LogData(nil, pebble.Sync)
+}
+
+// Close closes every group view and the underlying db. New calls fail with
+// pebble.ErrClosed at once, while calls already running are waited for, up to
+// PebbleDBConfig.CloseTimeout. If they have not finished by then, Close
+// returns an error wrapping ErrCloseTimeout and leaves the db open for them;
+// call Close again to keep waiting. Otherwise it returns the errors of the
+// final sync, flush and close of the db. Calling Close again after that
+// returns nil.
+func (e *PebbleEngine) Close() error {
+	if e == nil {
+		return nil
+	}
+
+	e.closeMu.Lock()
+	defer e.closeMu.Unlock()
+
+	if e.closeDone {
+		return nil
+	}
+
+	e.closed.Store(true)
+
+	e.mu.Lock()
+	for _, ps := range e.stores {
+		ps.closed.Store(true)
+		ps.feed.broadcast()
+	}
+	e.mu.Unlock()
+
+	// The committer and syncer keep running until every caller is served
+	if err := e.ops.drain(e.closeTimeout); err != nil {
+		return err
+	}
+
+	close(e.stopc)
+	e.bg.Wait()
+
+	var errs []error
+	if !e.readOnly {
+		if err := e.db.LogData(nil, pebble.Sync); err != nil {
+			errs = append(errs, fmt.Errorf("sync: %w", err))
+		}
+		if err := e.db.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("flush: %w", err))
+		}
+	}
+	if err := e.db.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	e.closeDone = true
+
+	return errors.Join(errs...)
+}
+
+// ErrCloseTimeout is returned by Close when calls using the db are still
+// running after PebbleDBConfig.CloseTimeout.
+var ErrCloseTimeout = errors.New("timed out waiting for in-flight operations")
+
+// opTracker counts the operations using a db without taking a lock, so the
+// atomic index reads stay lock free and groups sharing an engine do not
+// contend. Every successful acquire is paired with a release; once drain has
+// set closing, acquire fails, so the count can only go down. An acquire
+// increments before checking closing and drain sets closing before checking
+// the count, so one of the two always sees the other.
+type opTracker struct {
+	n       *atomic.Int64
+	closing *atomic.Bool
+	drained chan struct{}
+	once    sync.Once
+}
+
+func newOpTracker() *opTracker {
+	return &opTracker{
+		n:       atomic.NewInt64(0),
+		closing: atomic.NewBool(false),
+		drained: make(chan struct{}),
+	}
+}
+
+// acquire registers an operation. It returns false once drain was called.
+func (t *opTracker) acquire() bool {
+	t.n.Inc()
+	if t.closing.Load() {
+		t.release()
+		return false
+	}
+
+	return true
+}
+
+func (t *opTracker) release() {
+	if t.n.Dec() == 0 && t.closing.Load() {
+		t.once.Do(func() { close(t.drained) })
+	}
+}
+
+// drain refuses new operations and waits for the running ones, for at most
+// timeout when it is positive.
+func (t *opTracker) drain(timeout time.Duration) error {
+	t.closing.Store(true)
+	if t.n.Load() == 0 {
+		t.once.Do(func() { close(t.drained) })
+	}
+
+	if timeout <= 0 {
+		<-t.drained
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-t.drained:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w: %d still running after %s", ErrCloseTimeout, t.n.Load(), timeout)
+	}
+}
@@ -0,0 +1,163 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+func testPebbleEngine(t testing.TB) *PebbleEngine {
+	fh, err := ioutil.TempFile("", "pebble")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	os.Remove(fh.Name())
+
+	engine, err := NewPebbleEngine(fh.Name(), &Logger{}, DefaultPebbleDBConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return engine
+}
+
+func TestPebbleEngine_GroupsAreIsolated(t *testing.T) {
+	engine := testPebbleEngine(t)
+	defer os.RemoveAll(engine.path)
+	defer engine.Close()
+
+	group1, err := engine.Store(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	group2, err := engine.Store(2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The same group always maps to the same view
+	if again, _ := engine.Store(1); again != group1 {
+		t.Fatalf("expected the same store for group 1")
+	}
+
+	var logs1, logs2 []*raft.Log
+	for i := uint64(1); i <= 5; i++ {
+		logs1 = append(logs1, testRaftLog(i, fmt.Sprintf("g1-log%d", i)))
+		logs2 = append(logs2, testRaftLog(i+10, fmt.Sprintf("g2-log%d", i+10)))
+	}
+	if err := group1.StoreLogs(logs1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := group2.StoreLogs(logs2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if first, _ := group1.FirstIndex(); first != 1 {
+		t.Fatalf("bad: %d", first)
+	}
+	if last, _ := group1.LastIndex(); last != 5 {
+		t.Fatalf("bad: %d", last)
+	}
+	if first, _ := group2.FirstIndex(); first != 11 {
+		t.Fatalf("bad: %d", first)
+	}
+	if last, _ := group2.LastIndex(); last != 15 {
+		t.Fatalf("bad: %d", last)
+	}
+
+	// DeleteRange only touches its own group
+	if err := group1.DeleteRange(0, 100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := group1.GetLog(1, new(raft.Log)); err != raft.ErrLogNotFound {
+		t.Fatalf("should have deleted log1 of group 1")
+	}
+	log := new(raft.Log)
+	if err := group2.GetLog(11, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(log.Data) != "g2-log11" {
+		t.Fatalf("bad: %#v", log)
+	}
+
+	// Stable store keys are namespaced too
+	if err := group1.Set([]byte("k"), []byte("v1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := group2.Set([]byte("k"), []byte("v2")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := group1.SetUint64([]byte("term"), 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if val, _ := group1.Get([]byte("k")); !bytes.Equal(val, []byte("v1")) {
+		t.Fatalf("bad: %q", val)
+	}
+	if val, _ := group2.Get([]byte("k")); !bytes.Equal(val, []byte("v2")) {
+		t.Fatalf("bad: %q", val)
+	}
+	if val, _ := group2.GetUint64([]byte("term")); val != 0 {
+		t.Fatalf("bad: %d", val)
+	}
+}
+
+func TestPebbleEngine_Reopen(t *testing.T) {
+	engine := testPebbleEngine(t)
+	defer os.RemoveAll(engine.path)
+
+	for id := uint64(1); id <= 3; id++ {
+		store, err := engine.Store(id)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := store.StoreLogs([]*raft.Log{
+			testRaftLog(id*100, "a"),
+			testRaftLog(id*100+1, "b"),
+		}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Closing a view leaves the engine and other groups usable
+	store, _ := engine.Store(1)
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := store.LastIndex(); err != pebble.ErrClosed {
+		t.Fatalf("expected closed error, got: %v", err)
+	}
+	other, _ := engine.Store(2)
+	if _, err := other.LastIndex(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := engine.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := other.LastIndex(); err != pebble.ErrClosed {
+		t.Fatalf("expected closed error, got: %v", err)
+	}
+
+	engine, err := NewPebbleEngine(engine.path, &Logger{}, DefaultPebbleDBConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer engine.Close()
+
+	for id := uint64(1); id <= 3; id++ {
+		store, err := engine.Store(id)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		first, _ := store.FirstIndex()
+		last, _ := store.LastIndex()
+		if first != id*100 || last != id*100+1 {
+			t.Fatalf("group %d: bad indexes: %d %d", id, first, last)
+		}
+	}
+}
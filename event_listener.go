@@ -1,24 +1,90 @@
 package raftpebbledb
 
 import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/atomic"
+
 	"github.com/cockroachdb/pebble"
 )
 
+// ErrDegraded is wrapped by the error every write returns once a background
+// error has switched the store to read-only.
+var ErrDegraded = errors.New("pebbledb degraded to read-only")
+
+// errEmptyTable mirrors pebble's unexported error reported by FlushEnd when a
+// flush produced no sstable, which is not a failure.
+const errEmptyTable = "pebble: empty table"
+
+// eventListener is the default pebble event listener. Errors are logged and
+// passed to onError instead of killing the process. A background error, which
+// is how pebble reports a failed flush or compaction, additionally degrades
+// the db to read-only: reads keep working while writes fail.
 type eventListener struct {
-	log pebble.Logger
+	log      pebble.Logger
+	onError  func(err error)
+	degraded *atomic.Error
+}
+
+func newEventListener(logger pebble.Logger, onError func(err error)) *eventListener {
+	return &eventListener{
+		log:      logger,
+		onError:  onError,
+		degraded: atomic.NewError(nil),
+	}
+}
+
+// pebbleListener returns the hooks of l wired into a pebble.EventListener.
+func (l *eventListener) pebbleListener() pebble.EventListener {
+	return pebble.EventListener{
+		BackgroundError:  l.BackgroundError,
+		CompactionBegin:  l.CompactionBegin,
+		CompactionEnd:    l.CompactionEnd,
+		DiskSlow:         l.DiskSlow,
+		FlushBegin:       l.FlushBegin,
+		FlushEnd:         l.FlushEnd,
+		ManifestCreated:  l.ManifestCreated,
+		ManifestDeleted:  l.ManifestDeleted,
+		TableCreated:     l.TableCreated,
+		TableDeleted:     l.TableDeleted,
+		TableIngested:    l.TableIngested,
+		TableStatsLoaded: l.TableStatsLoaded,
+		WALCreated:       l.WALCreated,
+		WALDeleted:       l.WALDeleted,
+		WriteStallBegin:  l.WriteStallBegin,
+		WriteStallEnd:    l.WriteStallEnd,
+	}
+}
+
+// writable returns nil, or an error wrapping ErrDegraded and the background
+// error that degraded the db.
+func (l *eventListener) writable() error {
+	if err := l.degraded.Load(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDegraded, err)
+	}
+	return nil
+}
+
+func (l *eventListener) report(event string, err error) {
+	l.log.Infof("pebbledb %s error: %s\n", event, err.Error())
+	if l.onError != nil {
+		l.onError(fmt.Errorf("pebbledb %s: %w", event, err))
+	}
 }
 
 // BackgroundError is invoked whenever an error occurs during a background
 // operation such as flush or compaction.
 func (l *eventListener) BackgroundError(err error) {
-	l.log.Fatalf("pebbledb background error: %s\n", err.Error())
+	l.degraded.CompareAndSwap(nil, err)
+	l.report("background", err)
 }
 
 // CompactionBegin is invoked after the inputs to a compaction have been
 // determined, but before the compaction has produced any output.
 func (l *eventListener) CompactionBegin(info pebble.CompactionInfo) {
 	if info.Err != nil {
-		l.log.Fatalf("pebbledb compaction begin error: %s\n", info.Err.Error())
+		l.report("compaction begin", info.Err)
 	} else {
 		l.log.Infof("pebbledb compaction begin %s\n", info.String())
 	}
@@ -28,7 +94,7 @@ func (l *eventListener) CompactionBegin(info pebble.CompactionInfo) {
 // has been installed.
 func (l *eventListener) CompactionEnd(info pebble.CompactionInfo) {
 	if info.Err != nil {
-		l.log.Fatalf("pebbledb compaction end error: %s\n", info.Err.Error())
+		l.report("compaction end", info.Err)
 	} else {
 		l.log.Infof("pebbledb compaction end %s\n", info.String())
 	}
@@ -45,7 +111,7 @@ func (l *eventListener) DiskSlow(info pebble.DiskSlowInfo) {
 // but before the flush has produced any output.
 func (l *eventListener) FlushBegin(info pebble.FlushInfo) {
 	if info.Err != nil {
-		l.log.Fatalf("pebbledb flush begin error: %s\n", info.Err.Error())
+		l.report("flush begin", info.Err)
 	} else {
 		l.log.Infof("pebbledb flush begin %s\n", info.String())
 	}
@@ -54,8 +120,8 @@ func (l *eventListener) FlushBegin(info pebble.FlushInfo) {
 // FlushEnd is invoked after a flush has complated and the result has been
 // installed.
 func (l *eventListener) FlushEnd(info pebble.FlushInfo) {
-	if info.Err != nil {
-		l.log.Fatalf("pebbledb flush end error: %s\n", info.Err.Error())
+	if info.Err != nil && info.Err.Error() != errEmptyTable {
+		l.report("flush end", info.Err)
 	} else {
 		l.log.Infof("pebbledb flush end %s\n", info.String())
 	}
@@ -64,7 +130,7 @@ func (l *eventListener) FlushEnd(info pebble.FlushInfo) {
 // ManifestCreated is invoked after a manifest has been created.
 func (l *eventListener) ManifestCreated(info pebble.ManifestCreateInfo) {
 	if info.Err != nil {
-		l.log.Fatalf("pebbledb manifest created error: %s\n", info.Err.Error())
+		l.report("manifest created", info.Err)
 	} else {
 		l.log.Infof("pebbledb manifest created %s\n", info.String())
 	}
@@ -73,7 +139,7 @@ func (l *eventListener) ManifestCreated(info pebble.ManifestCreateInfo) {
 // ManifestDeleted is invoked after a manifest has been deleted.
 func (l *eventListener) ManifestDeleted(info pebble.ManifestDeleteInfo) {
 	if info.Err != nil {
-		l.log.Fatalf("pebbledb manifest deleted error: %s\n", info.Err.Error())
+		l.report("manifest deleted", info.Err)
 	} else {
 		l.log.Infof("pebbledb manifest deleted %s\n", info.String())
 	}
@@ -87,7 +153,7 @@ func (l *eventListener) TableCreated(info pebble.TableCreateInfo) {
 // TableDeleted is invoked after a table has been deleted.
 func (l *eventListener) TableDeleted(info pebble.TableDeleteInfo) {
 	if info.Err != nil {
-		l.log.Fatalf("pebbledb table deleted error: %s\n", info.Err.Error())
+		l.report("table deleted", info.Err)
 	} else {
 		l.log.Infof("pebbledb table deleted %s\n", info.String())
 	}
@@ -97,7 +163,7 @@ func (l *eventListener) TableDeleted(info pebble.TableDeleteInfo) {
 // ingested via a call to DB.Ingest().
 func (l *eventListener) TableIngested(info pebble.TableIngestInfo) {
 	if info.Err != nil {
-		l.log.Fatalf("pebbledb table ingested error: %s\n", info.Err.Error())
+		l.report("table ingested", info.Err)
 	} else {
 		l.log.Infof("pebbledb table ingested %s\n", info.String())
 	}
@@ -112,7 +178,7 @@ func (l *eventListener) TableStatsLoaded(info pebble.TableStatsInfo) {
 // WALCreated is invoked after a WAL has been created.
 func (l *eventListener) WALCreated(info pebble.WALCreateInfo) {
 	if info.Err != nil {
-		l.log.Fatalf("pebbledb wal created error: %s\n", info.Err.Error())
+		l.report("wal created", info.Err)
 	} else {
 		l.log.Infof("pebbledb wal created %s\n", info.String())
 	}
@@ -121,7 +187,7 @@ func (l *eventListener) WALCreated(info pebble.WALCreateInfo) {
 // WALDeleted is invoked after a WAL has been deleted.
 func (l *eventListener) WALDeleted(info pebble.WALDeleteInfo) {
 	if info.Err != nil {
-		l.log.Fatalf("pebbledb wal deleted error: %s\n", info.Err.Error())
+		l.report("wal deleted", info.Err)
 	} else {
 		l.log.Infof("pebbledb wal deleted %s\n", info.String())
 	}
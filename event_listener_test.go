@@ -0,0 +1,79 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+func TestEventListener_Degrade(t *testing.T) {
+	var reported []error
+	cfg := DefaultPebbleDBConfig()
+	cfg.OnError = func(err error) {
+		reported = append(reported, err)
+	}
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Engine().Degraded(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Simulate a failed compaction
+	cause := errors.New("disk on fire")
+	store.Engine().events.BackgroundError(cause)
+
+	if len(reported) != 1 || !errors.Is(reported[0], cause) {
+		t.Fatalf("bad: %v", reported)
+	}
+	if err := store.Engine().Degraded(); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("expected degraded error, got: %v", err)
+	}
+
+	// Writes fail, reads still work
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(2, "log2")}); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("expected degraded error, got: %v", err)
+	}
+	if err := store.DeleteRange(1, 1); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("expected degraded error, got: %v", err)
+	}
+	if err := store.SetUint64([]byte("k"), 1); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("expected degraded error, got: %v", err)
+	}
+	if err := store.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestEventListener_Custom(t *testing.T) {
+	var flushes int32
+	cfg := DefaultPebbleDBConfig()
+	cfg.EventListener = func(defaults pebble.EventListener) pebble.EventListener {
+		return pebble.TeeEventListener(defaults, pebble.EventListener{
+			FlushEnd: func(info pebble.FlushInfo) {
+				atomic.AddInt32(&flushes, 1)
+			},
+		})
+	}
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.db.Flush(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if atomic.LoadInt32(&flushes) == 0 {
+		t.Fatalf("custom listener was not called")
+	}
+}
@@ -0,0 +1,454 @@
+package raftpebbledb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"go.uber.org/atomic"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+)
+
+// fsmSnapshotMagic starts every snapshot written by PebbleFSM. The rest of
+// the stream is a single sstable holding the whole keyspace.
+var fsmSnapshotMagic = []byte("raftpebblefsm\x01")
+
+// fsmAppliedKey holds the index of the last log applied to the state, written
+// in the same batch as the commands. Snapshots carry it along with the rest of
+// the state.
+var fsmAppliedKey = []byte("__raft_applied__")
+
+// ApplyFunc applies the command in log to the FSM state by adding writes to
+// batch. Its return value is handed back to raft as the response of the
+// command. Writes to batch become visible once every command of the batch has
+// been applied.
+type ApplyFunc func(batch *pebble.Batch, log *raft.Log) interface{}
+
+// PebbleFSM is a raft.FSM and raft.BatchingFSM keeping its state in a pebble
+// db of its own. Commands are applied through an ApplyFunc into pebble
+// batches; Snapshot takes a pebble checkpoint, which hard links the sstables
+// instead of copying them, and Restore ingests the snapshot as an sstable.
+//
+// The FSM's db is only synced by raft's own log. Every batch also records the
+// index of its last log under the key "__raft_applied__", which ApplyFunc
+// must not write, and logs at or below it are skipped: after a restart raft
+// replays the log from its latest snapshot, or from the start without one,
+// on top of the state the FSM kept. The state is kept whether or not raft
+// restores the snapshot on start, see raft.Config.NoSnapshotRestoreOnStart.
+type PebbleFSM struct {
+	path   string
+	logger pebble.Logger
+	fs     vfs.FS
+	db     *pebble.DB
+	apply  ApplyFunc
+
+	// mu is held exclusively by Restore while it replaces the state and by
+	// Close, and shared by the other calls using db
+	mu sync.RWMutex
+
+	// applied is the index of the last log applied
+	applied *atomic.Uint64
+
+	checkpoints *atomic.Uint64
+	closed      *atomic.Bool
+}
+
+var (
+	_ raft.FSM         = (*PebbleFSM)(nil)
+	_ raft.BatchingFSM = (*PebbleFSM)(nil)
+)
+
+// NewPebbleFSM opens the FSM state at path. The pebble tuning fields and FS of
+// cfg apply to the FSM's db and its checkpoints, the log store settings are
+// ignored.
+func NewPebbleFSM(path string, logger pebble.Logger, cfg *PebbleDBConfig, apply ApplyFunc) (*PebbleFSM, error) {
+	if cfg == nil {
+		cfg = DefaultPebbleDBConfig()
+	}
+
+	fs := cfg.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+
+	db, err := openPebbleDB(cfg, path, logger, newEventListener(logger, cfg.OnError))
+	if err != nil {
+		return nil, err
+	}
+
+	// Checkpoints and restores left over by a previous process
+	for _, dir := range []string{fsmCheckpointDir(fs, path), fsmRestoreDir(fs, path)} {
+		if err := fs.RemoveAll(dir); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	f := &PebbleFSM{
+		path:        path,
+		logger:      logger,
+		fs:          fs,
+		db:          db,
+		apply:       apply,
+		applied:     atomic.NewUint64(0),
+		checkpoints: atomic.NewUint64(0),
+		closed:      atomic.NewBool(false),
+	}
+
+	if err := f.loadApplied(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// loadApplied reads the index of the last log applied to the state.
+func (f *PebbleFSM) loadApplied() error {
+	val, closer, err := f.db.Get(fsmAppliedKey)
+	if errors.Is(err, pebble.ErrNotFound) {
+		f.applied.Store(0)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	if len(val) != 8 {
+		return fmt.Errorf("bad applied index of %d bytes", len(val))
+	}
+	f.applied.Store(bytesToUint64(val))
+
+	return nil
+}
+
+func fsmCheckpointDir(fs vfs.FS, path string) string {
+	return fs.PathJoin(path, "checkpoints")
+}
+
+func fsmRestoreDir(fs vfs.FS, path string) string {
+	return fs.PathJoin(path, "restore")
+}
+
+// Apply implements raft.FSM.
+func (f *PebbleFSM) Apply(log *raft.Log) interface{} {
+	return f.ApplyBatch([]*raft.Log{log})[0]
+}
+
+// ApplyBatch implements raft.BatchingFSM, applying all commands of logs in a
+// single pebble batch. Logs the state already holds, replayed by raft after a
+// restart, are skipped with a nil response. If the batch fails to commit,
+// every command's response is the error.
+func (f *PebbleFSM) ApplyBatch(logs []*raft.Log) []interface{} {
+	resps := make([]interface{}, len(logs))
+
+	// Close waits for the batch; every command fails once it has run
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed.Load() {
+		for i := range resps {
+			resps[i] = pebble.ErrClosed
+		}
+		return resps
+	}
+
+	batch := f.db.NewBatch()
+	defer batch.Close()
+
+	applied := f.applied.Load()
+	last := applied
+	for i, log := range logs {
+		if log.Index <= applied {
+			continue
+		}
+		if log.Type == raft.LogCommand {
+			resps[i] = f.apply(batch, log)
+		}
+		last = max(last, log.Index)
+	}
+
+	if last == applied {
+		return resps
+	}
+
+	if err := batch.Set(fsmAppliedKey, uint64ToBytes(last), nil); err != nil {
+		return f.failBatch(logs, applied, resps, err)
+	}
+
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		return f.failBatch(logs, applied, resps, err)
+	}
+	f.applied.Store(last)
+
+	return resps
+}
+
+// failBatch sets the response of every command above applied to err.
+func (f *PebbleFSM) failBatch(logs []*raft.Log, applied uint64, resps []interface{}, err error) []interface{} {
+	f.logger.Infof("pebbledb fsm apply error: %s\n", err.Error())
+	for i, log := range logs {
+		if log.Index > applied && log.Type == raft.LogCommand {
+			resps[i] = err
+		}
+	}
+
+	return resps
+}
+
+// View calls fn with a consistent reader of the FSM state. fn must not close
+// the reader nor keep it, or anything read through it, after it returns.
+func (f *PebbleFSM) View(fn func(r pebble.Reader) error) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed.Load() {
+		return pebble.ErrClosed
+	}
+
+	return fn(f.db)
+}
+
+// Snapshot implements raft.FSM by taking a pebble checkpoint, which is cheap
+// whatever the size of the state. Persist streams it to the sink.
+func (f *PebbleFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed.Load() {
+		return nil, pebble.ErrClosed
+	}
+
+	if err := f.fs.MkdirAll(fsmCheckpointDir(f.fs, f.path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	dir := f.fs.PathJoin(fsmCheckpointDir(f.fs, f.path), fmt.Sprintf("%d", f.checkpoints.Inc()))
+	if err := f.db.Checkpoint(dir, pebble.WithFlushedWAL()); err != nil {
+		f.fs.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &pebbleFSMSnapshot{
+		logger: f.logger,
+		fs:     f.fs,
+		dir:    dir,
+		format: f.db.FormatMajorVersion().MaxTableFormat(),
+	}, nil
+}
+
+// Restore implements raft.FSM, replacing the whole state with a snapshot
+// written by Persist. The snapshot is staged as an sstable and ingested, and
+// the last applied index becomes the one it was taken at.
+func (f *PebbleFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	if f.closed.Load() {
+		return pebble.ErrClosed
+	}
+
+	staging := fsmRestoreDir(f.fs, f.path)
+	if err := f.fs.MkdirAll(staging, os.ModePerm); err != nil {
+		return err
+	}
+	defer f.fs.RemoveAll(staging)
+
+	path := f.fs.PathJoin(staging, "snapshot.sst")
+	if err := stageFSMSnapshot(f.fs, rc, path); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed.Load() {
+		return pebble.ErrClosed
+	}
+
+	if err := f.clear(); err != nil {
+		return err
+	}
+	f.applied.Store(0)
+
+	// An empty state is written as an sstable without entries, which pebble
+	// does not ingest
+	ok, err := sstableHasEntries(f.fs, path)
+	if err == nil && ok {
+		err = f.db.Ingest([]string{path})
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.loadApplied()
+}
+
+// clear deletes every key of the state.
+func (f *PebbleFSM) clear() error {
+	iter, err := f.db.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	if !iter.First() {
+		return iter.Error()
+	}
+	start := append([]byte{}, iter.Key()...)
+
+	if !iter.Last() {
+		return iter.Error()
+	}
+	end := append(append([]byte{}, iter.Key()...), 0)
+
+	return f.db.DeleteRange(start, end, pebble.Sync)
+}
+
+// stageFSMSnapshot checks the magic of a snapshot stream and writes the
+// sstable that follows it to path on fs.
+func stageFSMSnapshot(fs vfs.FS, r io.Reader, path string) error {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(fsmSnapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return fmt.Errorf("read fsm snapshot header: %w", err)
+	}
+	if string(magic) != string(fsmSnapshotMagic) {
+		return errors.New("not a pebble fsm snapshot")
+	}
+
+	file, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, br); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func sstableHasEntries(fs vfs.FS, path string) (bool, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return false, err
+	}
+
+	readable, err := sstable.NewSimpleReadable(file)
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+
+	reader, err := sstable.NewReader(readable, sstable.ReaderOptions{})
+	if err != nil {
+		readable.Close()
+		return false, err
+	}
+	defer reader.Close()
+
+	return reader.Properties.NumEntries > 0, nil
+}
+
+// Close closes the FSM's db once running Apply, View and Snapshot calls
+// return. Calling it again returns nil.
+func (f *PebbleFSM) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.closed.CAS(false, true) {
+		return nil
+	}
+
+	return f.db.Close()
+}
+
+// pebbleFSMSnapshot is a checkpoint of the FSM state waiting to be persisted.
+type pebbleFSMSnapshot struct {
+	logger pebble.Logger
+	fs     vfs.FS
+	dir    string
+	format sstable.TableFormat
+}
+
+// Persist implements raft.FSMSnapshot. It opens the checkpoint and streams
+// its live keys into the sink as one sstable, so Restore can ingest it
+// without rewriting.
+func (s *pebbleFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.persist(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *pebbleFSMSnapshot) persist(sink raft.SnapshotSink) error {
+	db, err := pebble.Open(s.dir, &pebble.Options{ReadOnly: true, FS: s.fs, Logger: s.logger})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	iter, err := db.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	if _, err := sink.Write(fsmSnapshotMagic); err != nil {
+		return err
+	}
+
+	w := sstable.NewWriter(&sinkWritable{w: sink}, sstable.WriterOptions{TableFormat: s.format})
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := w.Set(iter.Key(), iter.Value()); err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// Release implements raft.FSMSnapshot, deleting the checkpoint.
+func (s *pebbleFSMSnapshot) Release() {
+	s.fs.RemoveAll(s.dir)
+}
+
+// sinkWritable lets an sstable.Writer stream into an io.Writer. Durability is
+// left to the snapshot sink's Close.
+type sinkWritable struct {
+	w io.Writer
+}
+
+func (s *sinkWritable) Write(p []byte) error {
+	_, err := s.w.Write(p)
+	return err
+}
+
+func (s *sinkWritable) Finish() error {
+	return nil
+}
+
+func (s *sinkWritable) Abort() {}
@@ -0,0 +1,289 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+)
+
+// testPebbleFSM applies "key=value" commands and responds with the key
+func testPebbleFSM(t *testing.T) *PebbleFSM {
+	return testPebbleFSMWithConfig(t, nil)
+}
+
+func testPebbleFSMWithConfig(t *testing.T, cfg *PebbleDBConfig) *PebbleFSM {
+	fsm, err := NewPebbleFSM(filepath.Join(t.TempDir(), "fsm"), &Logger{}, cfg, func(batch *pebble.Batch, log *raft.Log) interface{} {
+		kv := bytes.SplitN(log.Data, []byte("="), 2)
+		if err := batch.Set(kv[0], kv[1], nil); err != nil {
+			return err
+		}
+		return string(kv[0])
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return fsm
+}
+
+func testFSMGet(t *testing.T, fsm *PebbleFSM, key string) string {
+	var val string
+	err := fsm.View(func(r pebble.Reader) error {
+		v, closer, err := r.Get([]byte(key))
+		if err == pebble.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		val = string(v)
+		return closer.Close()
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return val
+}
+
+func TestPebbleFSM_Apply(t *testing.T) {
+	fsm := testPebbleFSM(t)
+	defer fsm.Close()
+
+	if resp := fsm.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: []byte("a=1")}); resp != "a" {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	resps := fsm.ApplyBatch([]*raft.Log{
+		{Index: 2, Type: raft.LogCommand, Data: []byte("b=2")},
+		{Index: 3, Type: raft.LogConfiguration},
+		{Index: 4, Type: raft.LogCommand, Data: []byte("a=3")},
+	})
+	if len(resps) != 3 || resps[0] != "b" || resps[1] != nil || resps[2] != "a" {
+		t.Fatalf("bad: %v", resps)
+	}
+
+	if a, b := testFSMGet(t, fsm, "a"), testFSMGet(t, fsm, "b"); a != "3" || b != "2" {
+		t.Fatalf("bad: %s %s", a, b)
+	}
+}
+
+func TestPebbleFSM_ReopenReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fsm")
+
+	// Counts the commands applied, which replaying must not count twice
+	var fsm *PebbleFSM
+	open := func() {
+		t.Helper()
+
+		var err error
+		fsm, err = NewPebbleFSM(path, &Logger{}, nil, func(batch *pebble.Batch, log *raft.Log) interface{} {
+			n, err := strconv.Atoi(testFSMGet(t, fsm, "n"))
+			if err != nil {
+				n = 0
+			}
+			return batch.Set([]byte("n"), []byte(strconv.Itoa(n+1)), nil)
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	logs := []*raft.Log{
+		{Index: 1, Type: raft.LogCommand},
+		{Index: 2, Type: raft.LogCommand},
+		{Index: 3, Type: raft.LogCommand},
+	}
+
+	open()
+	for _, log := range logs {
+		fsm.Apply(log)
+	}
+	if n := testFSMGet(t, fsm, "n"); n != "3" {
+		t.Fatalf("bad: %s", n)
+	}
+	fsm.Close()
+
+	// Without a snapshot raft replays the whole log after a restart, on top
+	// of the state kept
+	open()
+	defer fsm.Close()
+
+	if n := testFSMGet(t, fsm, "n"); n != "3" {
+		t.Fatalf("state not kept: %s", n)
+	}
+	for _, log := range logs {
+		if resp := fsm.Apply(log); resp != nil {
+			t.Fatalf("bad: %v", resp)
+		}
+	}
+	fsm.Apply(&raft.Log{Index: 4, Type: raft.LogCommand})
+	if n := testFSMGet(t, fsm, "n"); n != "4" {
+		t.Fatalf("bad: %s", n)
+	}
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer snap.Release()
+
+	snaps := raft.NewInmemSnapshotStore()
+	_, trans := raft.NewInmemTransport("")
+	sink, err := snaps.Create(raft.SnapshotVersionMax, 4, 1, raft.Configuration{}, 1, trans)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fsm.Apply(&raft.Log{Index: 5, Type: raft.LogCommand})
+	fsm.Apply(&raft.Log{Index: 6, Type: raft.LogCommand})
+
+	// Restoring moves the applied index back to the snapshot's
+	_, rc, err := snaps.Open(sink.ID())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := fsm.Restore(rc); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if applied := fsm.applied.Load(); applied != 4 {
+		t.Fatalf("bad: %d", applied)
+	}
+	fsm.Apply(&raft.Log{Index: 5, Type: raft.LogCommand})
+	if n := testFSMGet(t, fsm, "n"); n != "5" {
+		t.Fatalf("bad: %s", n)
+	}
+}
+
+func TestPebbleFSM_SnapshotRestore(t *testing.T) {
+	testFSMSnapshotRestore(t, nil)
+}
+
+func TestPebbleFSM_SnapshotRestoreInMemory(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.FS = vfs.NewMem()
+
+	testFSMSnapshotRestore(t, cfg)
+}
+
+func testFSMSnapshotRestore(t *testing.T, cfg *PebbleDBConfig) {
+	src := testPebbleFSMWithConfig(t, cfg)
+	defer src.Close()
+
+	for i := 0; i < 1000; i++ {
+		src.Apply(&raft.Log{Index: uint64(i + 1), Type: raft.LogCommand, Data: []byte(fmt.Sprintf("key%04d=val%d", i, i))})
+	}
+
+	snap, err := src.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer snap.Release()
+
+	// Writes after the snapshot are not part of it
+	src.Apply(&raft.Log{Index: 1001, Type: raft.LogCommand, Data: []byte("late=1")})
+
+	snaps := raft.NewInmemSnapshotStore()
+	_, trans := raft.NewInmemTransport("")
+	sink, err := snaps.Create(raft.SnapshotVersionMax, 10, 1, raft.Configuration{}, 1, trans)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dst := testPebbleFSMWithConfig(t, cfg)
+	defer dst.Close()
+
+	// Restore replaces existing state
+	dst.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: []byte("stale=1")})
+	dst.Apply(&raft.Log{Index: 2000, Type: raft.LogCommand, Data: []byte("zzz=1")})
+
+	_, rc, err := snaps.Open(sink.ID())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := dst.Restore(rc); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, key := range []string{"stale", "zzz", "late"} {
+		if val := testFSMGet(t, dst, key); val != "" {
+			t.Fatalf("bad %s: %s", key, val)
+		}
+	}
+	for i := 0; i < 1000; i += 99 {
+		if val := testFSMGet(t, dst, fmt.Sprintf("key%04d", i)); val != fmt.Sprintf("val%d", i) {
+			t.Fatalf("bad: %s", val)
+		}
+	}
+
+	// The restored state keeps accepting commands
+	dst.Apply(&raft.Log{Index: 1001, Type: raft.LogCommand, Data: []byte("key0000=new")})
+	if val := testFSMGet(t, dst, "key0000"); val != "new" {
+		t.Fatalf("bad: %s", val)
+	}
+
+	if _, err := dst.fs.Stat(fsmRestoreDir(dst.fs, dst.path)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("restore staging dir remains: %v", err)
+	}
+
+	// Nothing was written outside the FSM's filesystem
+	if dst.fs != vfs.Default {
+		for _, path := range []string{src.path, dst.path} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("%s exists on disk: %v", path, err)
+			}
+		}
+	}
+}
+
+func TestPebbleFSM_RestoreEmpty(t *testing.T) {
+	src := testPebbleFSM(t)
+	defer src.Close()
+
+	snap, err := src.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer snap.Release()
+
+	snaps := raft.NewInmemSnapshotStore()
+	_, trans := raft.NewInmemTransport("")
+	sink, _ := snaps.Create(raft.SnapshotVersionMax, 10, 1, raft.Configuration{}, 1, trans)
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dst := testPebbleFSM(t)
+	defer dst.Close()
+	dst.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: []byte("a=1")})
+
+	_, rc, _ := snaps.Open(sink.ID())
+	if err := dst.Restore(rc); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if val := testFSMGet(t, dst, "a"); val != "" {
+		t.Fatalf("bad: %s", val)
+	}
+
+	if err := dst.Restore(&readCloser{bytes.NewReader([]byte("garbage garbage"))}); err == nil {
+		t.Fatalf("expected error restoring garbage")
+	}
+}
+
+type readCloser struct {
+	*bytes.Reader
+}
+
+func (readCloser) Close() error { return nil }
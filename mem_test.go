@@ -0,0 +1,90 @@
+package raftpebbledb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/hashicorp/raft"
+)
+
+func TestPebbleStore_InMemory(t *testing.T) {
+	store, err := NewPebbleStoreInMemory(&Logger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	log := new(raft.Log)
+	if err := store.GetLog(2, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, testRaftLog(2, "log2")) {
+		t.Fatalf("bad: %#v", log)
+	}
+}
+
+func TestPebbleStore_InMemoryReopen(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.FS = vfs.NewMem()
+
+	store, err := NewPebbleStoreInMemory(&Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64([]byte("CurrentTerm"), 5); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	store, err = NewPebbleStoreInMemory(&Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if term, err := store.GetUint64([]byte("CurrentTerm")); err != nil || term != 5 {
+		t.Fatalf("bad: %d %v", term, err)
+	}
+}
+
+func TestPebbleStore_StrictMemDropsUnsynced(t *testing.T) {
+	fs := vfs.NewStrictMem()
+	cfg := DefaultPebbleDBConfig()
+	cfg.FS = fs
+	cfg.Durability = SyncNever
+
+	store, err := NewPebbleStoreInMemory(&Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Crash: nothing written from here on reaches the disk
+	fs.SetIgnoreSyncs(true)
+	store.Close()
+	fs.ResetToSyncedState()
+	fs.SetIgnoreSyncs(false)
+
+	store, err = NewPebbleStoreInMemory(&Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if last, _ := store.LastIndex(); last != 1 {
+		t.Fatalf("bad: %d", last)
+	}
+}
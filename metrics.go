@@ -0,0 +1,159 @@
+package raftpebbledb
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Operation labels of the latency histogram
+const (
+	opStoreLogs   = "store_logs"
+	opGetLog      = "get_log"
+	opGetLogs     = "get_logs"
+	opDeleteRange = "delete_range"
+	opGet         = "get"
+	opSet         = "set"
+)
+
+// Collector is a prometheus.Collector exporting the internals of a
+// PebbleEngine's db together with per-operation latency histograms of every
+// store it serves. Latencies are only recorded once the collector has been
+// created, so stores that do not use it pay nothing.
+type Collector struct {
+	engine  *PebbleEngine
+	latency *prometheus.HistogramVec
+
+	compactions     *prometheus.Desc
+	compactionDebt  *prometheus.Desc
+	flushes         *prometheus.Desc
+	l0Files         *prometheus.Desc
+	l0Sublevels     *prometheus.Desc
+	memtableSize    *prometheus.Desc
+	memtableCount   *prometheus.Desc
+	cacheSize       *prometheus.Desc
+	cacheHits       *prometheus.Desc
+	cacheMisses     *prometheus.Desc
+	cacheHitRate    *prometheus.Desc
+	walFiles        *prometheus.Desc
+	walSize         *prometheus.Desc
+	walBytesIn      *prometheus.Desc
+	walBytesWritten *prometheus.Desc
+	diskUsage       *prometheus.Desc
+
+	logCompactions    *prometheus.Desc
+	logReclaimedBytes *prometheus.Desc
+	logPendingBytes   *prometheus.Desc
+}
+
+// NewCollector creates a collector for engine and starts recording operation
+// latencies. Register it with a prometheus.Registerer to expose it.
+func NewCollector(namespace string, engine *PebbleEngine) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "pebble", name), help, nil, nil)
+	}
+
+	c := &Collector{
+		engine: engine,
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "pebble",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of PebbleStore operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10), // 10us ~ 2.6s
+		}, []string{"op"}),
+
+		compactions:     desc("compactions_total", "Number of compactions performed."),
+		compactionDebt:  desc("compaction_debt_bytes", "Estimated number of bytes that need compacting."),
+		flushes:         desc("flushes_total", "Number of memtable flushes performed."),
+		l0Files:         desc("l0_files", "Number of sstables in L0."),
+		l0Sublevels:     desc("l0_sublevels", "Number of L0 sublevels."),
+		memtableSize:    desc("memtable_size_bytes", "Bytes allocated by memtables."),
+		memtableCount:   desc("memtable_count", "Number of memtables."),
+		cacheSize:       desc("block_cache_size_bytes", "Bytes in use by the block cache."),
+		cacheHits:       desc("block_cache_hits_total", "Number of block cache hits."),
+		cacheMisses:     desc("block_cache_misses_total", "Number of block cache misses."),
+		cacheHitRate:    desc("block_cache_hit_rate", "Block cache hit rate since open, between 0 and 1."),
+		walFiles:        desc("wal_files", "Number of live WAL files."),
+		walSize:         desc("wal_size_bytes", "Size of the live data in the WAL."),
+		walBytesIn:      desc("wal_bytes_in_total", "Logical bytes written to the WAL."),
+		walBytesWritten: desc("wal_bytes_written_total", "Physical bytes written to the WAL."),
+		diskUsage:       desc("disk_usage_bytes", "Total disk space used by the db."),
+
+		logCompactions:    desc("log_compactions_total", "Number of deleted log ranges compacted."),
+		logReclaimedBytes: desc("log_compaction_reclaimed_bytes_total", "Estimated disk space freed by compacting deleted log ranges."),
+		logPendingBytes:   desc("log_compaction_pending_bytes", "Estimated disk space of deleted log ranges not compacted yet."),
+	}
+
+	engine.latency.Store(c.latency)
+
+	return c
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.latency.Describe(ch)
+
+	for _, d := range []*prometheus.Desc{
+		c.compactions, c.compactionDebt, c.flushes, c.l0Files, c.l0Sublevels,
+		c.memtableSize, c.memtableCount, c.cacheSize, c.cacheHits, c.cacheMisses,
+		c.cacheHitRate, c.walFiles, c.walSize, c.walBytesIn, c.walBytesWritten,
+		c.diskUsage, c.logCompactions, c.logReclaimedBytes, c.logPendingBytes,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector. The db gauges are skipped once the
+// engine has been closed.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.latency.Collect(ch)
+
+	logs := c.engine.LogCompactionStats()
+	ch <- prometheus.MustNewConstMetric(c.logCompactions, prometheus.CounterValue, float64(logs.Compactions))
+	ch <- prometheus.MustNewConstMetric(c.logReclaimedBytes, prometheus.CounterValue, float64(logs.ReclaimedBytes))
+	ch <- prometheus.MustNewConstMetric(c.logPendingBytes, prometheus.GaugeValue, float64(logs.PendingBytes))
+
+	if !c.engine.ops.acquire() {
+		return
+	}
+	m := c.engine.db.Metrics()
+	c.engine.ops.release()
+
+	hitRate := 0.0
+	if total := m.BlockCache.Hits + m.BlockCache.Misses; total > 0 {
+		hitRate = float64(m.BlockCache.Hits) / float64(total)
+	}
+
+	counter := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v)
+	}
+	gauge := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+
+	counter(c.compactions, float64(m.Compact.Count))
+	gauge(c.compactionDebt, float64(m.Compact.EstimatedDebt))
+	counter(c.flushes, float64(m.Flush.Count))
+	gauge(c.l0Files, float64(m.Levels[0].NumFiles))
+	gauge(c.l0Sublevels, float64(m.Levels[0].Sublevels))
+	gauge(c.memtableSize, float64(m.MemTable.Size))
+	gauge(c.memtableCount, float64(m.MemTable.Count))
+	gauge(c.cacheSize, float64(m.BlockCache.Size))
+	counter(c.cacheHits, float64(m.BlockCache.Hits))
+	counter(c.cacheMisses, float64(m.BlockCache.Misses))
+	gauge(c.cacheHitRate, hitRate)
+	gauge(c.walFiles, float64(m.WAL.Files))
+	gauge(c.walSize, float64(m.WAL.Size))
+	counter(c.walBytesIn, float64(m.WAL.BytesIn))
+	counter(c.walBytesWritten, float64(m.WAL.BytesWritten))
+	gauge(c.diskUsage, float64(m.DiskSpaceUsage()))
+}
+
+// observe records the latency of op started at start if a collector is
+// attached. Call it deferred: defer e.observe(opGet, time.Now()).
+func (e *PebbleEngine) observe(op string, start time.Time) {
+	if h := e.latency.Load(); h != nil {
+		h.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	}
+}
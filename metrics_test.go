@@ -0,0 +1,74 @@
+package raftpebbledb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(NewCollector("raft", store.Engine())); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.DeleteRange(1, 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := store.Get([]byte("k")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	found := make(map[string]bool)
+	ops := make(map[string]uint64)
+	for _, f := range families {
+		found[f.GetName()] = true
+		if f.GetName() != "raft_pebble_operation_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				ops[l.GetValue()] = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+
+	for _, name := range []string{
+		"raft_pebble_compactions_total",
+		"raft_pebble_l0_files",
+		"raft_pebble_memtable_size_bytes",
+		"raft_pebble_block_cache_hit_rate",
+		"raft_pebble_wal_bytes_written_total",
+		"raft_pebble_log_compaction_reclaimed_bytes_total",
+	} {
+		if !found[name] {
+			t.Fatalf("missing metric %s", name)
+		}
+	}
+
+	for _, op := range []string{opStoreLogs, opGetLog, opDeleteRange, opSet, opGet} {
+		if ops[op] != 1 {
+			t.Fatalf("bad sample count for %s: %d", op, ops[op])
+		}
+	}
+}
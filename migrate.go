@@ -0,0 +1,261 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Buckets of a raft-boltdb file
+	boltLogs = []byte("logs")
+	boltConf = []byte("conf")
+
+	// ErrStoreNotEmpty is returned by MigrateBoltDB when the destination
+	// store already holds data.
+	ErrStoreNotEmpty = errors.New("destination store is not empty")
+)
+
+// migrateBatchSize is the number of entries written per StoreLogs call while
+// migrating.
+const migrateBatchSize = 1024
+
+// MigrateOptions tunes MigrateBoltDB.
+type MigrateOptions struct {
+	// Uint64Keys are the conf keys raft-boltdb holds for SetUint64. They
+	// are written with SetUint64, every other key with Set. raft-boltdb
+	// keeps both kinds in the same bucket, so the split cannot be inferred
+	// from the file. Defaults to the keys used by hashicorp/raft.
+	Uint64Keys []string
+}
+
+// MigrateResult reports what MigrateBoltDB copied.
+type MigrateResult struct {
+	Logs       uint64
+	FirstIndex uint64
+	LastIndex  uint64
+	StableKeys int
+}
+
+// MigrateBoltDB copies the logs and stable store of the raft-boltdb file at
+// boltPath into dst, which must be empty. The bolt file is opened read-only.
+// The copy is verified before returning: the entry count and first and last
+// index of dst must match the source and every stable key must read back.
+// Logs are re-encoded with dst's codec, compression and encryption settings.
+func MigrateBoltDB(boltPath string, dst *PebbleStore, opts *MigrateOptions) (*MigrateResult, error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+
+	uint64Keys := opts.Uint64Keys
+	if uint64Keys == nil {
+		uint64Keys = []string{"CurrentTerm", "LastVoteTerm"}
+	}
+
+	if err := checkEmpty(dst); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(boltPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	result := new(MigrateResult)
+	err = db.View(func(tx *bolt.Tx) error {
+		if err := migrateBoltLogs(tx, dst, result); err != nil {
+			return err
+		}
+		return migrateBoltConf(tx, dst, uint64Keys, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Whatever the durability mode, the copy is on disk once we return
+	if err := dst.Sync(); err != nil {
+		return nil, err
+	}
+
+	if err := verifyMigration(dst, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func checkEmpty(ps *PebbleStore) error {
+	last, err := ps.LastIndex()
+	if err != nil {
+		return err
+	}
+	if last != 0 {
+		return ErrStoreNotEmpty
+	}
+
+	empty := true
+	stop := errors.New("stop")
+	err = ps.forEachStable(ps.confPrefix, func(key, val []byte) error {
+		empty = false
+		return stop
+	})
+	if err == nil {
+		err = ps.forEachStable(ps.defPrefix, func(key, val []byte) error {
+			empty = false
+			return stop
+		})
+	}
+	if err != nil && err != stop {
+		return err
+	}
+
+	if !empty {
+		return ErrStoreNotEmpty
+	}
+
+	return nil
+}
+
+func migrateBoltLogs(tx *bolt.Tx, dst *PebbleStore, result *MigrateResult) error {
+	bucket := tx.Bucket(boltLogs)
+	if bucket == nil {
+		return nil
+	}
+
+	logs := make([]*raft.Log, 0, migrateBatchSize)
+	flush := func() error {
+		if len(logs) == 0 {
+			return nil
+		}
+		if err := dst.StoreLogs(logs); err != nil {
+			return err
+		}
+		logs = logs[:0]
+		return nil
+	}
+
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if len(k) != 8 {
+			return fmt.Errorf("bad bolt log key %x", k)
+		}
+
+		index := bytesToUint64(k)
+		log := new(raft.Log)
+		if err := decodeMsgPack(v, log); err != nil {
+			return &CorruptLogError{Index: index, Err: err}
+		}
+		if log.Index != index {
+			return &CorruptLogError{Index: index, Err: fmt.Errorf("entry holds index %d", log.Index)}
+		}
+
+		if result.FirstIndex == 0 {
+			result.FirstIndex = index
+		}
+		result.LastIndex = index
+		result.Logs++
+
+		logs = append(logs, log)
+		if len(logs) == migrateBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+func migrateBoltConf(tx *bolt.Tx, dst *PebbleStore, uint64Keys []string, result *MigrateResult) error {
+	bucket := tx.Bucket(boltConf)
+	if bucket == nil {
+		return nil
+	}
+
+	isUint64 := make(map[string]bool, len(uint64Keys))
+	for _, key := range uint64Keys {
+		isUint64[key] = true
+	}
+
+	return bucket.ForEach(func(k, v []byte) error {
+		if isUint64[string(k)] {
+			if len(v) != 8 {
+				return fmt.Errorf("bolt key %q holds %d bytes, not a uint64", k, len(v))
+			}
+			if err := dst.SetUint64(k, bytesToUint64(v)); err != nil {
+				return err
+			}
+			if got, err := dst.GetUint64(k); err != nil || got != bytesToUint64(v) {
+				return fmt.Errorf("verify %q: read back %d, %v", k, got, err)
+			}
+		} else {
+			if err := dst.Set(k, v); err != nil {
+				return err
+			}
+			// Get reports an empty value as missing
+			if got, err := dst.Get(k); len(v) > 0 && (err != nil || !bytes.Equal(got, v)) {
+				return fmt.Errorf("verify %q: read back %q, %v", k, got, err)
+			}
+		}
+
+		result.StableKeys++
+		return nil
+	})
+}
+
+// verifyMigration checks dst holds as many entries and stable keys as the
+// source, spanning the same indexes. Stable values were already read back as
+// they were copied.
+func verifyMigration(dst *PebbleStore, result *MigrateResult) error {
+	first, err := dst.FirstIndex()
+	if err != nil {
+		return err
+	}
+
+	last, err := dst.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	if first != result.FirstIndex || last != result.LastIndex {
+		return fmt.Errorf("migrated logs span %d-%d, source spans %d-%d", first, last, result.FirstIndex, result.LastIndex)
+	}
+
+	if !dst.acquire() {
+		return pebble.ErrClosed
+	}
+	logs, _, err := dst.logSizes(0, math.MaxUint64)
+	dst.release()
+	if err != nil {
+		return err
+	}
+
+	if logs != result.Logs {
+		return fmt.Errorf("migrated %d log entries, source holds %d", logs, result.Logs)
+	}
+
+	keys := 0
+	count := func([]byte, []byte) error {
+		keys++
+		return nil
+	}
+	if err := dst.forEachStable(dst.confPrefix, count); err != nil {
+		return err
+	}
+	if err := dst.forEachStable(dst.defPrefix, count); err != nil {
+		return err
+	}
+
+	if keys != result.StableKeys {
+		return fmt.Errorf("migrated %d stable keys, source holds %d", keys, result.StableKeys)
+	}
+
+	return nil
+}
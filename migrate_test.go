@@ -0,0 +1,108 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testBoltDB writes a file laid out like raft-boltdb's, with entries first
+// to last.
+func testBoltDB(t *testing.T, first, last uint64) string {
+	path := filepath.Join(t.TempDir(), "raft.db")
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		logs, err := tx.CreateBucket(boltLogs)
+		if err != nil {
+			return err
+		}
+		for i := first; i <= last; i++ {
+			buf, err := encodeMsgPack(testRaftLog(i, "log"))
+			if err != nil {
+				return err
+			}
+			if err := logs.Put(uint64ToBytes(i), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		conf, err := tx.CreateBucket(boltConf)
+		if err != nil {
+			return err
+		}
+		if err := conf.Put([]byte("CurrentTerm"), uint64ToBytes(7)); err != nil {
+			return err
+		}
+		if err := conf.Put([]byte("LastVoteTerm"), uint64ToBytes(6)); err != nil {
+			return err
+		}
+		return conf.Put([]byte("LastVoteCand"), []byte("node1"))
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return path
+}
+
+func TestMigrateBoltDB(t *testing.T) {
+	boltPath := testBoltDB(t, 5, 3000)
+
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	result, err := MigrateBoltDB(boltPath, store, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := &MigrateResult{Logs: 2996, FirstIndex: 5, LastIndex: 3000, StableKeys: 3}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	log := new(raft.Log)
+	if err := store.GetLog(1234, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, testRaftLog(1234, "log")) {
+		t.Fatalf("bad: %#v", log)
+	}
+
+	if term, err := store.GetUint64([]byte("CurrentTerm")); err != nil || term != 7 {
+		t.Fatalf("bad: %d %v", term, err)
+	}
+	if cand, err := store.Get([]byte("LastVoteCand")); err != nil || string(cand) != "node1" {
+		t.Fatalf("bad: %q %v", cand, err)
+	}
+
+	// A second run would mix two histories
+	if _, err := MigrateBoltDB(boltPath, store, nil); !errors.Is(err, ErrStoreNotEmpty) {
+		t.Fatalf("expected not empty error, got: %v", err)
+	}
+}
+
+func TestMigrateBoltDB_BadUint64(t *testing.T) {
+	boltPath := testBoltDB(t, 1, 1)
+
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	opts := &MigrateOptions{Uint64Keys: []string{"LastVoteCand"}}
+	if _, err := MigrateBoltDB(boltPath, store, opts); err == nil {
+		t.Fatalf("expected error migrating a non uint64 value")
+	}
+}
@@ -2,30 +2,89 @@ package raftpebbledb
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"os"
-	"path/filepath"
+	"time"
 
 	"go.uber.org/atomic"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
 	"github.com/hashicorp/raft"
 )
 
 var (
 	// Bucket names we perform transactions in
-	dbLogs = []byte("__logs__")
-	dbConf = []byte("__conf__")
-	def    = []byte("__def__")
+	dbLogs  = []byte("__logs__")
+	dbConf  = []byte("__conf__")
+	def     = []byte("__def__")
+	dbSnaps = []byte("__snaps__")
 
 	// An error indicating a given key does not exist
 	ErrKeyNotFound = errors.New("not found")
+
+	// ErrCorruptLog is matched by errors.Is for every CorruptLogError
+	ErrCorruptLog = errors.New("corrupt log entry")
+
+	// ErrReadOnly is returned by every write to a store opened read-only
+	ErrReadOnly = errors.New("store is read-only")
+
+	// ErrNonMonotonicLogs is matched by errors.Is for every LogGapError
+	ErrNonMonotonicLogs = errors.New("non-monotonic log index")
 )
 
+// LogGapError is returned by StoreLogs in monotonic mode when a batch would
+// leave a gap in, or rewind, the log. Expected is the index the store needed
+// next and Received is the index it was given instead.
+type LogGapError struct {
+	Expected uint64
+	Received uint64
+}
+
+func (e *LogGapError) Error() string {
+	return fmt.Sprintf("%s: expected %d, received %d", ErrNonMonotonicLogs, e.Expected, e.Received)
+}
+
+func (e *LogGapError) Is(target error) bool {
+	return target == ErrNonMonotonicLogs
+}
+
 type PebbleStore struct {
 	path   string
 	logger pebble.Logger
 	db     *pebble.DB
 
+	// engine owns db. A store created by NewPebbleStore owns a private
+	// engine and closes it on Close; a view handed out by
+	// PebbleEngine.Store leaves it open.
+	engine *PebbleEngine
+	owner  bool
+
+	// Bucket prefixes, namespaced by group for engine views
+	logsPrefix []byte
+	confPrefix []byte
+	defPrefix  []byte
+	snapPrefix []byte
+
+	// firstIndex and lastIndex mirror the bounds of the __logs__ bucket so
+	// FirstIndex and LastIndex never touch the db. They are loaded at open
+	// and only updated by StoreLogs and DeleteRange while holding the
+	// engine's writeMu, after the corresponding batch has been committed.
+	firstIndex *atomic.Uint64
+	lastIndex  *atomic.Uint64
+
+	// retention counts the log's entries and bytes when a retention policy
+	// is configured, nil otherwise
+	retention *retentionTracker
+
+	// archive writes the entries DeleteRange removes to ArchiveDir when
+	// archive mode is on, nil otherwise
+	archive *logArchiver
+
+	// feed wakes and rewinds the store's subscriptions
+	feed *logFeed
+
 	closed *atomic.Bool
 }
 
@@ -34,191 +93,518 @@ func NewPebbleStore(path string, logger pebble.Logger, cfg *PebbleDBConfig) (*Pe
 		cfg = DefaultPebbleDBConfig()
 	}
 
-	db, err := OpenPebbleDB(cfg, path, logger)
+	engine, err := newPebbleEngine(path, logger, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	ps := &PebbleStore{
-		path:   path,
-		logger: logger,
-		db:     db,
-		closed: atomic.NewBool(false),
+	ps, err := newPebbleStore(engine, nil)
+	if err != nil {
+		engine.Close()
+		return nil, err
 	}
+	ps.owner = true
+
+	// Rotating keys resizes values, the log is counted first
+	engine.startReencrypt(cfg)
 
 	return ps, nil
 }
 
-// FirstIndex returns the first index written. 0 for no entries.
-func (ps *PebbleStore) FirstIndex() (uint64, error) {
-	if ps.isclosed() {
-		return 0, pebble.ErrClosed
+// NewPebbleStoreReadOnly opens the store at path without ever modifying it:
+// pebble is opened read-only, no directory is created, and StoreLogs,
+// DeleteRange, Set and SetUint64 return ErrReadOnly. Other fields of cfg
+// apply as for NewPebbleStore.
+func NewPebbleStoreReadOnly(path string, logger pebble.Logger, cfg *PebbleDBConfig) (*PebbleStore, error) {
+	if cfg == nil {
+		cfg = DefaultPebbleDBConfig()
 	}
 
-	iter, err := ps.db.NewIter(&pebble.IterOptions{
-		LowerBound: dbLogs,
-	})
+	ro := *cfg
+	ro.ReadOnly = true
 
-	if err != nil {
-		return 0, err
+	return NewPebbleStore(path, logger, &ro)
+}
+
+// NewPebbleStoreInMemory returns a store kept entirely in memory by pebble's
+// vfs.NewMem, for tests. It behaves exactly like an on-disk store; its data
+// is gone once closed. Set cfg.FS to keep the filesystem around, e.g. to
+// reopen the store or drop unsynced writes of a vfs.NewStrictMem.
+func NewPebbleStoreInMemory(logger pebble.Logger, cfg *PebbleDBConfig) (*PebbleStore, error) {
+	if cfg == nil {
+		cfg = DefaultPebbleDBConfig()
 	}
 
-	defer iter.Close()
+	mem := *cfg
+	if mem.FS == nil {
+		mem.FS = vfs.NewMem()
+	}
+
+	return NewPebbleStore("/raft", logger, &mem)
+}
 
-	if !iter.Valid() {
-		return 0, errors.New("NewIter returns an iterator that is unpositioned")
+func newPebbleStore(engine *PebbleEngine, namespace []byte) (*PebbleStore, error) {
+	ps := &PebbleStore{
+		path:   engine.path,
+		logger: engine.logger,
+		db:     engine.db,
+		engine: engine,
+		closed: atomic.NewBool(false),
+
+		logsPrefix: concatBytes(namespace, dbLogs),
+		confPrefix: concatBytes(namespace, dbConf),
+		defPrefix:  concatBytes(namespace, def),
+		snapPrefix: concatBytes(namespace, dbSnaps),
+		firstIndex: atomic.NewUint64(0),
+		lastIndex:  atomic.NewUint64(0),
+		feed:       newLogFeed(),
 	}
 
-	if !iter.First() {
-		return 0, nil
+	if err := ps.loadIndexes(); err != nil {
+		return nil, err
 	}
 
-	key := iter.Key()
-	if len(key) == 0 {
-		return 0, nil
+	if engine.retention.enabled() {
+		ps.retention = &retentionTracker{retentionPolicy: engine.retention}
+		if err := ps.initRetention(); err != nil {
+			return nil, err
+		}
+	}
+
+	if engine.archiveDir != "" {
+		archive, err := newLogArchiver(engine, namespace)
+		if err != nil {
+			return nil, err
+		}
+		ps.archive = archive
+	}
+
+	return ps, nil
+}
+
+// FirstIndex returns the first index written. 0 for no entries.
+func (ps *PebbleStore) FirstIndex() (uint64, error) {
+	if !ps.acquire() {
+		return 0, pebble.ErrClosed
 	}
+	defer ps.release()
 
-	return bytesToUint64(ps.dblogKey(key)), nil
+	return ps.firstIndex.Load(), nil
 }
 
 // LastIndex returns the last index written. 0 for no entries.
 func (ps *PebbleStore) LastIndex() (uint64, error) {
-	if ps.isclosed() {
+	if !ps.acquire() {
 		return 0, pebble.ErrClosed
 	}
+	defer ps.release()
 
-	iter, err := ps.db.NewIter(&pebble.IterOptions{
-		LowerBound: dbLogs,
-	})
+	return ps.lastIndex.Load(), nil
+}
 
+// loadIndexes reads the first and last log index from the db. Every write is
+// committed before the cached indexes move, so after a restart the db is the
+// source of truth.
+func (ps *PebbleStore) loadIndexes() error {
+	iter, err := ps.db.NewIter(ps.logIterOptions())
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	defer iter.Close()
 
-	if !iter.Valid() {
-		return 0, errors.New("NewIter returns an iterator that is unpositioned")
+	var first, last uint64
+	if iter.First() {
+		first = bytesToUint64(ps.dblogKey(iter.Key()))
+	}
+	if iter.Last() {
+		last = bytesToUint64(ps.dblogKey(iter.Key()))
 	}
 
-	if !iter.Last() {
-		return 0, nil
+	if err := iter.Error(); err != nil {
+		return err
 	}
 
-	key := iter.Key()
-	if len(key) == 0 {
-		return 0, nil
+	ps.firstIndex.Store(first)
+	ps.lastIndex.Store(last)
+
+	return nil
+}
+
+// seekIndex returns the index of the first log at or after index when
+// forward is true, or the last log strictly before index otherwise. 0 when
+// there is no such log.
+func (ps *PebbleStore) seekIndex(index uint64, forward bool) (uint64, error) {
+	iter, err := ps.db.NewIter(ps.logIterOptions())
+	if err != nil {
+		return 0, err
+	}
+
+	defer iter.Close()
+
+	key := ps.buildKey(ps.logsPrefix, uint64ToBytes(index))
+
+	var ok bool
+	if forward {
+		ok = iter.SeekGE(key)
+	} else {
+		ok = iter.SeekLT(key)
 	}
 
-	return bytesToUint64(ps.dblogKey(key)), nil
+	if !ok {
+		return 0, iter.Error()
+	}
+
+	return bytesToUint64(ps.dblogKey(iter.Key())), nil
 }
 
 // GetLog gets a log entry at a given index.
 func (ps *PebbleStore) GetLog(index uint64, log *raft.Log) error {
-	if ps.isclosed() {
+	if !ps.acquire() {
 		return pebble.ErrClosed
 	}
+	defer ps.release()
 
-	key := ps.buildKey(dbLogs, uint64ToBytes(index))
+	defer ps.engine.observe(opGetLog, time.Now())
+
+	return ps.readLog(index, log)
+}
+
+// readLog is GetLog for callers holding the store.
+func (ps *PebbleStore) readLog(index uint64, log *raft.Log) error {
+	key := ps.buildKey(ps.logsPrefix, uint64ToBytes(index))
+
+	// Decode straight from pebble's buffer, decode copies what it keeps
+	val, closer, err := ps.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return raft.ErrLogNotFound
+	}
 
-	val, err := ps.getBytes(key)
 	if err != nil {
 		return err
 	}
 
-	if len(val) == 0 {
-		return raft.ErrLogNotFound
+	defer closer.Close()
+
+	val, err = ps.engine.openLogValue(index, key, val)
+	if err != nil {
+		return err
+	}
+
+	return ps.engine.codec.decode(index, val, log)
+}
+
+// GetLogs returns the contiguous run of log entries starting at lo and ending
+// at hi (inclusive), read with a single iterator. It stops early at a gap or
+// once the encoded entries exceed maxBytes, but always returns the first
+// entry; maxBytes <= 0 means no limit. raft.ErrLogNotFound is returned when
+// lo itself does not exist.
+func (ps *PebbleStore) GetLogs(lo, hi uint64, maxBytes int) ([]raft.Log, error) {
+	if !ps.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer ps.release()
+
+	defer ps.engine.observe(opGetLogs, time.Now())
+
+	if hi < lo {
+		return nil, nil
+	}
+
+	iter, err := ps.db.NewIter(&pebble.IterOptions{
+		LowerBound: ps.buildKey(ps.logsPrefix, uint64ToBytes(lo)),
+		UpperBound: ps.logIterUpperBound(hi),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer iter.Close()
+
+	var (
+		logs  []raft.Log
+		size  int
+		index = lo
+	)
+
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if bytesToUint64(ps.dblogKey(iter.Key())) != index {
+			break
+		}
+
+		val := iter.Value()
+		if len(logs) > 0 && maxBytes > 0 && size+len(val) > maxBytes {
+			break
+		}
+		size += len(val)
+
+		logs = append(logs, raft.Log{})
+		val, err := ps.engine.openLogValue(index, iter.Key(), val)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ps.engine.codec.decode(index, val, &logs[len(logs)-1]); err != nil {
+			return nil, err
+		}
+
+		index++
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if len(logs) == 0 {
+		return nil, raft.ErrLogNotFound
+	}
+
+	return logs, nil
+}
+
+// NextIndex returns the index of the first log entry at or after index, or 0
+// when there is none. Readers walking a log with gaps left by DeleteRange use
+// it to skip a gap with a single seek.
+func (ps *PebbleStore) NextIndex(index uint64) (uint64, error) {
+	if !ps.acquire() {
+		return 0, pebble.ErrClosed
 	}
+	defer ps.release()
 
-	return decodeMsgPack(val, log)
+	return ps.seekIndex(index, true)
 }
 
 // StoreLog stores a log entry.
 func (ps *PebbleStore) StoreLog(log *raft.Log) error {
-	if ps.isclosed() {
+	if !ps.acquire() {
 		return pebble.ErrClosed
 	}
+	defer ps.release()
 
 	return ps.StoreLogs([]*raft.Log{log})
 }
 
 // StoreLogs stores multiple log entries. By default the logs stored may not be contiguous with previous logs (i.e. may have a gap in Index since the last log written). If an implementation can't tolerate this it may optionally implement `MonotonicLogStore` to indicate that this is not allowed. This changes Raft's behaviour after restoring a user snapshot to remove all previous logs instead of relying on a "gap" to signal the discontinuity between logs before the snapshot and logs after.
 func (ps *PebbleStore) StoreLogs(logs []*raft.Log) error {
-	if ps.isclosed() {
+	if !ps.acquire() {
 		return pebble.ErrClosed
 	}
+	defer ps.release()
+
+	defer ps.engine.observe(opStoreLogs, time.Now())
+
+	if len(logs) == 0 {
+		return nil
+	}
+
+	min, max := logs[0].Index, logs[0].Index
+	var size uint64
+	sizes := make([]uint64, 0, len(logs))
+
+	sealer, err := ps.engine.sealer()
+	if err != nil {
+		return err
+	}
 
 	batch := ps.db.NewBatch()
 	defer batch.Close()
 
 	for _, log := range logs {
-		key := uint64ToBytes(log.Index)
-		val, err := encodeMsgPack(log)
+		if log.Index < min {
+			min = log.Index
+		}
+		if log.Index > max {
+			max = log.Index
+		}
+
+		key := ps.buildKey(ps.logsPrefix, uint64ToBytes(log.Index))
+		val, err := ps.engine.codec.encode(log)
 		if err != nil {
 			return err
 		}
 
-		if err := batch.Set(ps.buildKey(dbLogs, key), val.Bytes(), pebble.Sync); err != nil {
+		val, err = sealer.seal(key, val)
+		if err != nil {
 			return err
 		}
+
+		if err := batch.Set(key, val, pebble.Sync); err != nil {
+			return err
+		}
+		size += uint64(len(val))
+		sizes = append(sizes, uint64(len(val)))
+	}
+
+	return ps.engine.commit(&commitRequest{
+		store: ps,
+		batch: batch,
+		logs:  logs,
+		min:   min,
+		max:   max,
+		size:  size,
+		sizes: sizes,
+	})
+}
+
+// IsMonotonic implements raft.MonotonicLogStore. It reports whether the store
+// was opened with PebbleDBConfig.Monotonic, in which case StoreLogs refuses
+// batches that are not contiguous with the existing log.
+func (ps *PebbleStore) IsMonotonic() bool {
+	return ps.engine.monotonic
+}
+
+// checkMonotonic verifies that logs continue directly from last and are
+// contiguous among themselves. An empty store accepts any starting index.
+func checkMonotonic(last uint64, logs []*raft.Log) error {
+	next := logs[0].Index
+	if last > 0 {
+		next = last + 1
+	}
+
+	for _, log := range logs {
+		if log.Index != next {
+			return &LogGapError{Expected: next, Received: log.Index}
+		}
+		next++
 	}
 
-	return batch.Commit(pebble.Sync)
+	return nil
 }
 
 // DeleteRange deletes a range of log entries, [min, max]. The range is inclusive.
 func (ps *PebbleStore) DeleteRange(min, max uint64) error {
-	if ps.isclosed() {
+	if !ps.acquire() {
 		return pebble.ErrClosed
 	}
+	defer ps.release()
+
+	defer ps.engine.observe(opDeleteRange, time.Now())
+
+	start := ps.buildKey(ps.logsPrefix, uint64ToBytes(min))
+	end := ps.logIterUpperBound(max)
 
-	minKey := uint64ToBytes(min)
-	maxKey := uint64ToBytes(max + 1)
+	// Sized before taking the write lock, the logs are on disk either way
+	deleted, err := ps.trackDeletedLogs(start, end)
+	if err != nil {
+		return err
+	}
+
+	// Archived before taking the write lock too, so the other groups keep
+	// committing while the segment is written
+	var archivedFirst uint64
+	if ps.archive != nil {
+		if err := ps.engine.writable(); err != nil {
+			return err
+		}
+		if archivedFirst, err = ps.archiveLogs(min, max); err != nil {
+			return err
+		}
+	}
+
+	ps.engine.writeMu.Lock()
+	defer ps.engine.writeMu.Unlock()
+
+	if err := ps.engine.writable(); err != nil {
+		return err
+	}
+
+	var entries, bytes uint64
+	if ps.retention != nil {
+		if entries, bytes, err = ps.logSizes(min, max); err != nil {
+			return err
+		}
+	}
+
+	// The log changed while it was archived, archive what is there now
+	if ps.archive != nil && ps.firstIndex.Load() != archivedFirst {
+		if _, err := ps.archiveLogs(min, max); err != nil {
+			return err
+		}
+	}
+
+	if err := ps.db.DeleteRange(start, end, ps.engine.durability.writeOptions(false)); err != nil {
+		return err
+	}
+
+	ps.engine.compactor.add(deleted)
+
+	first, last := ps.firstIndex.Load(), ps.lastIndex.Load()
+	if err := ps.trimIndexes(min, max); err != nil {
+		return err
+	}
 
-	return ps.db.DeleteRange(ps.buildKey(dbLogs, minKey), ps.buildKey(dbLogs, maxKey), pebble.Sync)
+	if first != 0 && min <= last && max >= first {
+		through := max
+		if through > last {
+			through = last
+		}
+		ps.feed.deleted(min, through, through < last)
+	}
 
-	// iter := ps.db.NewIter(&pebble.IterOptions{
-	// 	LowerBound: ps.buildKey(dbLogs, minKey),
-	// })
-	// defer iter.Close()
+	if ps.retention != nil {
+		ps.retention.add(0, 0, entries, bytes)
+		ps.checkRetention()
+	}
 
-	// if !iter.Valid() {
-	// 	return 0, errors.New("NewIter returns an iterator that is unpositioned")
-	// }
+	return nil
+}
 
-	// batch := ps.db.NewBatch()
-	// defer batch.Close()
+// trimIndexes moves the cached bounds after [min, max] has been deleted. Only
+// a range that covers an end of the log changes it, and the new end is read
+// back from the db so gaps left by earlier writes are respected.
+func (ps *PebbleStore) trimIndexes(min, max uint64) error {
+	first, last := ps.firstIndex.Load(), ps.lastIndex.Load()
+	if first == 0 || max < first || min > last {
+		return nil
+	}
 
-	// for iter.First(); iter.Valid(); iter.Next() {
-	// 	key := iter.Key()
+	if min <= first && max >= last {
+		ps.firstIndex.Store(0)
+		ps.lastIndex.Store(0)
+		return nil
+	}
 
-	// 	// Handle out-of-range log index
-	// 	if bytesToUint64(ps.dblogKey(key)) > max {
-	// 		break
-	// 	}
+	if min <= first {
+		idx, err := ps.seekIndex(max+1, true)
+		if err != nil {
+			return err
+		}
+		ps.firstIndex.Store(idx)
+	}
 
-	// 	batch.Delete(key, pebble.Sync)
-	// }
+	if max >= last {
+		idx, err := ps.seekIndex(min, false)
+		if err != nil {
+			return err
+		}
+		ps.lastIndex.Store(idx)
+	}
 
-	// return batch.Commit(pebble.Sync)
+	return nil
 }
 
 // Set is used to set a key/value set outside of the raft log
 func (ps *PebbleStore) Set(key, val []byte) error {
-	if ps.isclosed() {
+	if !ps.acquire() {
 		return pebble.ErrClosed
 	}
+	defer ps.release()
 
-	return ps.db.Set(ps.buildKey(dbConf, key), val, pebble.Sync)
+	defer ps.engine.observe(opSet, time.Now())
+
+	return ps.setBytes(ps.buildKey(ps.confPrefix, key), val)
 }
 
 // Get is used to retrieve a value from the k/v store by key
 func (ps *PebbleStore) Get(key []byte) ([]byte, error) {
-	if ps.isclosed() {
+	if !ps.acquire() {
 		return nil, pebble.ErrClosed
 	}
+	defer ps.release()
+
+	defer ps.engine.observe(opGet, time.Now())
 
-	val, err := ps.getBytes(ps.buildKey(dbConf, key))
+	val, err := ps.getStableBytes(ps.buildKey(ps.confPrefix, key))
 	if err != nil {
 		return nil, err
 	}
@@ -232,20 +618,26 @@ func (ps *PebbleStore) Get(key []byte) ([]byte, error) {
 
 // SetUint64 is like Set, but handles uint64 values
 func (ps *PebbleStore) SetUint64(key []byte, val uint64) error {
-	if ps.isclosed() {
+	if !ps.acquire() {
 		return pebble.ErrClosed
 	}
+	defer ps.release()
+
+	defer ps.engine.observe(opSet, time.Now())
 
-	return ps.db.Set(ps.buildKey(def, key), uint64ToBytes(val), pebble.Sync)
+	return ps.setBytes(ps.buildKey(ps.defPrefix, key), uint64ToBytes(val))
 }
 
 // GetUint64 is like Get, but handles uint64 values
 func (ps *PebbleStore) GetUint64(key []byte) (uint64, error) {
-	if ps.isclosed() {
+	if !ps.acquire() {
 		return 0, pebble.ErrClosed
 	}
+	defer ps.release()
 
-	val, err := ps.getBytes(ps.buildKey(def, key))
+	defer ps.engine.observe(opGet, time.Now())
+
+	val, err := ps.getStableBytes(ps.buildKey(ps.defPrefix, key))
 	if err != nil {
 		return 0, err
 	}
@@ -254,22 +646,118 @@ func (ps *PebbleStore) GetUint64(key []byte) (uint64, error) {
 		return 0, nil
 	}
 
+	if len(val) != 8 {
+		return 0, fmt.Errorf("bad uint64 value of %d bytes", len(val))
+	}
+
 	return bytesToUint64(val), nil
 }
 
+// ForEach calls fn for every key stored with Set, in key order, stopping at
+// the first error fn returns.
+func (ps *PebbleStore) ForEach(fn func(key, val []byte) error) error {
+	return ps.forEachStable(ps.confPrefix, fn)
+}
+
+// ForEachUint64 calls fn for every key stored with SetUint64, in key order,
+// stopping at the first error fn returns.
+func (ps *PebbleStore) ForEachUint64(fn func(key []byte, val uint64) error) error {
+	return ps.forEachStable(ps.defPrefix, func(key, val []byte) error {
+		if len(val) != 8 {
+			return fmt.Errorf("bad uint64 value of %d bytes for %q", len(val), key)
+		}
+		return fn(key, bytesToUint64(val))
+	})
+}
+
+func (ps *PebbleStore) forEachStable(prefix []byte, fn func(key, val []byte) error) error {
+	if !ps.acquire() {
+		return pebble.ErrClosed
+	}
+	defer ps.release()
+
+	iter, err := ps.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		val := iter.Value()
+		if len(val) != 8 {
+			if val, err = ps.engine.openStableValue(iter.Key(), val); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(iter.Key()[len(prefix):], val); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
 func (ps *PebbleStore) buildKey(prefix, key []byte) []byte {
-	return append(prefix, key...)
+	return concatBytes(prefix, key)
+}
+
+func (ps *PebbleStore) logIterOptions() *pebble.IterOptions {
+	return &pebble.IterOptions{
+		LowerBound: ps.logsPrefix,
+		UpperBound: prefixUpperBound(ps.logsPrefix),
+	}
+}
+
+// logIterUpperBound returns the exclusive upper bound for iterating logs up
+// to and including index.
+func (ps *PebbleStore) logIterUpperBound(index uint64) []byte {
+	if index == math.MaxUint64 {
+		return prefixUpperBound(ps.logsPrefix)
+	}
+	return ps.buildKey(ps.logsPrefix, uint64ToBytes(index+1))
 }
 
 func (ps *PebbleStore) dblogKey(key []byte) []byte {
-	return key[len(dbLogs):]
+	return key[len(ps.logsPrefix):]
 }
 
-func (ps *PebbleStore) getBytes(key []byte) ([]byte, error) {
-	if ps.closed.Load() {
-		return []byte{}, pebble.ErrClosed
+func (ps *PebbleStore) setBytes(key, val []byte) error {
+	val, err := ps.engine.sealValue(key, val)
+	if err != nil {
+		return err
+	}
+
+	batch := ps.db.NewBatch()
+	defer batch.Close()
+
+	if err := batch.Set(key, val, pebble.Sync); err != nil {
+		return err
+	}
+
+	return ps.engine.commit(&commitRequest{store: ps, batch: batch, stable: true})
+}
+
+// getStableBytes is getBytes for Set/SetUint64 values, decrypting them when
+// the engine has a key provider.
+func (ps *PebbleStore) getStableBytes(key []byte) ([]byte, error) {
+	val, err := ps.getBytes(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// A plaintext uint64 written before encryption was enabled
+	if len(val) == 8 {
+		return val, nil
 	}
 
+	return ps.engine.openStableValue(key, val)
+}
+
+func (ps *PebbleStore) getBytes(key []byte) ([]byte, error) {
 	val, closer, err := ps.db.Get(key)
 	// 查询的key不存在，返回空值
 	if err == pebble.ErrNotFound {
@@ -295,27 +783,61 @@ func (ps *PebbleStore) isclosed() bool {
 	return ps.closed.Load()
 }
 
+// acquire registers a call using the db, which Close waits for. It returns
+// false once the store or its engine is closed. Every successful acquire is
+// paired with release.
+func (ps *PebbleStore) acquire() bool {
+	if ps.closed.Load() {
+		return false
+	}
+	return ps.engine.ops.acquire()
+}
+
+func (ps *PebbleStore) release() {
+	ps.engine.ops.release()
+}
+
+// Engine returns the engine serving the store, which for a store created by
+// NewPebbleStore is private to it.
+func (ps *PebbleStore) Engine() *PebbleEngine {
+	return ps.engine
+}
+
+// Close closes the store. A store created by NewPebbleStore also closes its
+// engine, see PebbleEngine.Close; a PebbleEngine view only stops serving
+// requests.
 func (ps *PebbleStore) Close() error {
 	if ps == nil {
 		return nil
 	}
 
-	ps.closed.Store(true) // set pebbledb closed
+	ps.closed.Store(true)
+	ps.feed.broadcast()
 
-	if ps.db != nil {
-		ps.db.Flush()
-		ps.db.Close()
-		ps.db = nil
+	// Closing again retries an engine Close that timed out
+	if ps.owner {
+		return ps.engine.Close()
 	}
 
 	return nil
 }
 
+// Sync forces a durable barrier: every write acknowledged before it returns
+// is on disk regardless of the durability mode.
 func (ps *PebbleStore) Sync() error {
-	return ps.db.Flush()
+	if !ps.acquire() {
+		return pebble.ErrClosed
+	}
+	defer ps.release()
+
+	return ps.engine.Sync()
 }
 
 func OpenPebbleDB(cfg *PebbleDBConfig, dir string, logger pebble.Logger) (*pebble.DB, error) {
+	return openPebbleDB(cfg, dir, logger, newEventListener(logger, cfg.OnError))
+}
+
+func openPebbleDB(cfg *PebbleDBConfig, dir string, logger pebble.Logger, event *eventListener) (*pebble.DB, error) {
 	blockSize := cfg.KVBlockSize
 	levelSizeMultiplier := cfg.KVTargetFileSizeMultiplier
 	sz := cfg.KVTargetFileSizeBase
@@ -331,14 +853,23 @@ func OpenPebbleDB(cfg *PebbleDBConfig, dir string, logger pebble.Logger) (*pebbl
 		lopts = append(lopts, opt)
 	}
 
-	dataPath := filepath.Join(dir, "data")
-	if err := os.MkdirAll(dataPath, os.ModePerm); err != nil {
-		return nil, err
+	fs := cfg.FS
+	if fs == nil {
+		fs = vfs.Default
 	}
 
-	walPath := filepath.Join(dir, "wal")
-	if err := os.MkdirAll(walPath, os.ModePerm); err != nil {
-		return nil, err
+	dataPath := fs.PathJoin(dir, "data")
+	walPath := fs.PathJoin(dir, "wal")
+
+	// A read-only open must find an existing store
+	if !cfg.ReadOnly {
+		if err := mkdirAllSynced(fs, dataPath); err != nil {
+			return nil, err
+		}
+
+		if err := mkdirAllSynced(fs, walPath); err != nil {
+			return nil, err
+		}
 	}
 
 	cache := pebble.NewCache(cfg.KVLRUCacheSize)
@@ -357,30 +888,15 @@ func OpenPebbleDB(cfg *PebbleDBConfig, dir string, logger pebble.Logger) (*pebbl
 		MaxOpenFiles:                cfg.KVMaxOpenFiles,
 		MaxConcurrentCompactions:    func() int { return cfg.KVMaxConcurrentCompactions },
 		WALBytesPerSync:             cfg.KVWALBytesPerSync,
+		ReadOnly:                    cfg.ReadOnly,
+		FS:                          fs,
 	}
 
-	event := &eventListener{
-		log: logger,
-	}
-
-	opts.EventListener = &pebble.EventListener{
-		BackgroundError:  event.BackgroundError,
-		CompactionBegin:  event.CompactionBegin,
-		CompactionEnd:    event.CompactionEnd,
-		DiskSlow:         event.DiskSlow,
-		FlushBegin:       event.FlushBegin,
-		FlushEnd:         event.FlushEnd,
-		ManifestCreated:  event.ManifestCreated,
-		ManifestDeleted:  event.ManifestDeleted,
-		TableCreated:     event.TableCreated,
-		TableDeleted:     event.TableDeleted,
-		TableIngested:    event.TableIngested,
-		TableStatsLoaded: event.TableStatsLoaded,
-		WALCreated:       event.WALCreated,
-		WALDeleted:       event.WALDeleted,
-		WriteStallBegin:  event.WriteStallBegin,
-		WriteStallEnd:    event.WriteStallEnd,
+	listener := event.pebbleListener()
+	if cfg.EventListener != nil {
+		listener = cfg.EventListener(listener)
 	}
+	opts.EventListener = &listener
 
 	db, err := pebble.Open(dataPath, opts)
 	if err != nil {
@@ -390,3 +906,25 @@ func OpenPebbleDB(cfg *PebbleDBConfig, dir string, logger pebble.Logger) (*pebbl
 
 	return db, nil
 }
+
+// mkdirAllSynced is MkdirAll that also syncs the parent of every directory it
+// creates, so a fresh store does not vanish in a crash after its first
+// synced write.
+func mkdirAllSynced(fs vfs.FS, dir string) error {
+	if _, err := fs.Stat(dir); err == nil {
+		return nil
+	}
+
+	parent := fs.PathDir(dir)
+	if parent != dir {
+		if err := mkdirAllSynced(fs, parent); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	return syncDir(fs, parent)
+}
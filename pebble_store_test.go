@@ -2,8 +2,10 @@ package raftpebbledb
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"reflect"
 	"testing"
@@ -38,6 +40,21 @@ func testPebbleStore(t testing.TB) *PebbleStore {
 	return store
 }
 
+func testPebbleStoreWithConfig(t testing.TB, cfg *PebbleDBConfig) *PebbleStore {
+	fh, err := ioutil.TempFile("", "pebble")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	os.Remove(fh.Name())
+
+	store, err := NewPebbleStore(fh.Name(), &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return store
+}
+
 func testRaftLog(idx uint64, data string) *raft.Log {
 	return &raft.Log{
 		Data:  []byte(data),
@@ -45,6 +62,28 @@ func testRaftLog(idx uint64, data string) *raft.Log {
 	}
 }
 
+// testLogRange returns the command logs first to last of term, each holding
+// data.
+func testLogRange(first, last, term uint64, data []byte) []*raft.Log {
+	logs := make([]*raft.Log, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: term, Type: raft.LogCommand, Data: data})
+	}
+	return logs
+}
+
+// testStoreLogRange stores testLogRange(first, last, term, data) and returns
+// the logs.
+func testStoreLogRange(t testing.TB, store *PebbleStore, first, last, term uint64, data []byte) []*raft.Log {
+	t.Helper()
+
+	logs := testLogRange(first, last, term, data)
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return logs
+}
+
 func TestPebbleStore_Implements(t *testing.T) {
 	var store interface{} = &PebbleStore{}
 	if _, ok := store.(raft.StableStore); !ok {
@@ -53,6 +92,84 @@ func TestPebbleStore_Implements(t *testing.T) {
 	if _, ok := store.(raft.LogStore); !ok {
 		t.Fatalf("PebbleStore does not implement raft.LogStore")
 	}
+	if _, ok := store.(raft.MonotonicLogStore); !ok {
+		t.Fatalf("PebbleStore does not implement raft.MonotonicLogStore")
+	}
+}
+
+func TestPebbleStore_Monotonic(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.Monotonic = true
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer store.Close()
+	defer os.Remove(store.path)
+
+	if !store.IsMonotonic() {
+		t.Fatalf("expected monotonic store")
+	}
+
+	// An empty store accepts any starting index
+	if err := store.StoreLogs([]*raft.Log{
+		testRaftLog(5, "log5"),
+		testRaftLog(6, "log6"),
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		name     string
+		logs     []*raft.Log
+		expected uint64
+		received uint64
+	}{
+		{"gap", []*raft.Log{testRaftLog(8, "log8")}, 7, 8},
+		{"rewind", []*raft.Log{testRaftLog(6, "log6")}, 7, 6},
+		{"gap in batch", []*raft.Log{testRaftLog(7, "log7"), testRaftLog(9, "log9")}, 8, 9},
+	}
+	for _, c := range cases {
+		err := store.StoreLogs(c.logs)
+		if !errors.Is(err, ErrNonMonotonicLogs) {
+			t.Fatalf("%s: expected non-monotonic error, got: %v", c.name, err)
+		}
+		var gap *LogGapError
+		if !errors.As(err, &gap) || gap.Expected != c.expected || gap.Received != c.received {
+			t.Fatalf("%s: bad: %v", c.name, err)
+		}
+	}
+
+	// Rejected batches must not be partially written
+	if err := store.GetLog(7, new(raft.Log)); err != raft.ErrLogNotFound {
+		t.Fatalf("expected raft log not found error, got: %v", err)
+	}
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(7, "log7")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// After removing every log the store accepts a new starting point
+	if err := store.DeleteRange(5, 7); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(100, "log100")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestPebbleStore_NonMonotonic(t *testing.T) {
+	store := testPebbleStore(t)
+	defer store.Close()
+	defer os.Remove(store.path)
+
+	if store.IsMonotonic() {
+		t.Fatalf("expected non-monotonic store by default")
+	}
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(10, "log10")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
 }
 
 func TestPebbleStore_FirstIndex(t *testing.T) {
@@ -247,6 +364,74 @@ func TestPebbleStore_DeleteRange(t *testing.T) {
 	}
 }
 
+func TestPebbleStore_DeleteRangeMaxUint64(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.RetentionMaxBytes = math.MaxUint64
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+		testRaftLog(3, "log3"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Raft deletes a conflicting suffix through math.MaxUint64
+	if err := store.DeleteRange(2, math.MaxUint64); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.GetLog(2, new(raft.Log)); err != raft.ErrLogNotFound {
+		t.Fatalf("should have deleted log2")
+	}
+	if err := store.GetLog(3, new(raft.Log)); err != raft.ErrLogNotFound {
+		t.Fatalf("should have deleted log3")
+	}
+	if idx, err := store.LastIndex(); err != nil || idx != 1 {
+		t.Fatalf("bad: %d, %v", idx, err)
+	}
+	testCheckRetention(t, store, 1)
+
+	if err := store.DeleteRange(0, math.MaxUint64); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.GetLog(1, new(raft.Log)); err != raft.ErrLogNotFound {
+		t.Fatalf("should have deleted log1")
+	}
+	if idx, err := store.FirstIndex(); err != nil || idx != 0 {
+		t.Fatalf("bad: %d, %v", idx, err)
+	}
+	testCheckRetention(t, store, 0)
+}
+
+func TestPebbleStore_NextIndex(t *testing.T) {
+	store := testPebbleStore(t)
+	defer store.Close()
+	defer os.Remove(store.path)
+
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(5, "log5"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for index, want := range map[uint64]uint64{0: 1, 1: 1, 2: 5, 5: 5, 6: 0} {
+		next, err := store.NextIndex(index)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if next != want {
+			t.Fatalf("bad: next of %d is %d, expected %d", index, next, want)
+		}
+	}
+}
+
 func TestPebbleStore_Set_Get(t *testing.T) {
 	store := testPebbleStore(t)
 	defer store.Close()
@@ -300,3 +485,141 @@ func TestPebbleStore_SetUint64_GetUint64(t *testing.T) {
 		t.Fatalf("bad: %v", val)
 	}
 }
+
+func TestPebbleStore_IndexesAfterDeleteAndReopen(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, testRaftLog(i, fmt.Sprintf("log%d", i)))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	checkIndexes := func(store *PebbleStore, first, last uint64) {
+		t.Helper()
+		idx, err := store.FirstIndex()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != first {
+			t.Fatalf("bad first index: %d, expected %d", idx, first)
+		}
+		idx, err = store.LastIndex()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if idx != last {
+			t.Fatalf("bad last index: %d, expected %d", idx, last)
+		}
+	}
+
+	checkIndexes(store, 1, 10)
+
+	// Truncate the head and the tail
+	if err := store.DeleteRange(1, 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkIndexes(store, 4, 10)
+	if err := store.DeleteRange(8, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkIndexes(store, 4, 7)
+
+	// Deleting from the middle leaves the bounds alone
+	if err := store.DeleteRange(5, 6); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkIndexes(store, 4, 7)
+
+	// Truncating into the gap skips over it
+	if err := store.DeleteRange(1, 4); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkIndexes(store, 7, 7)
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The bounds are rebuilt from disk on restart
+	store, err := NewPebbleStore(store.path, &Logger{}, DefaultPebbleDBConfig())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkIndexes(store, 7, 7)
+
+	if err := store.DeleteRange(0, 100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkIndexes(store, 0, 0)
+	store.Close()
+}
+
+func TestPebbleStore_GetLogs(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	// Should return an error on non-existent log
+	if _, err := store.GetLogs(1, 10, 0); err != raft.ErrLogNotFound {
+		t.Fatalf("expected raft log not found error, got: %v", err)
+	}
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, testRaftLog(i, fmt.Sprintf("log%02d", i)))
+	}
+	logs = append(logs, testRaftLog(12, "log12"))
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Full range without a budget
+	result, err := store.GetLogs(3, 7, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != 5 {
+		t.Fatalf("bad: %d", len(result))
+	}
+	for i, log := range result {
+		if !reflect.DeepEqual(&log, logs[i+2]) {
+			t.Fatalf("bad: %#v", log)
+		}
+	}
+
+	// Stops at the gap after 10
+	result, err = store.GetLogs(8, 20, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != 3 || result[2].Index != 10 {
+		t.Fatalf("bad: %v", result)
+	}
+
+	// A tiny budget still returns the first entry
+	result, err = store.GetLogs(1, 10, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != 1 || result[0].Index != 1 {
+		t.Fatalf("bad: %v", result)
+	}
+
+	// A budget of two encoded entries
+	val, _ := testLogCodec(CodecBinary).encode(logs[0])
+	result, err = store.GetLogs(1, 10, 2*len(val))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("bad: %d", len(result))
+	}
+
+	if _, err := store.GetLogs(11, 12, 0); err != raft.ErrLogNotFound {
+		t.Fatalf("expected raft log not found error, got: %v", err)
+	}
+}
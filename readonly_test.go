@@ -0,0 +1,72 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestPebbleStore_ReadOnly(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64([]byte("CurrentTerm"), 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	cfg := DefaultPebbleDBConfig()
+	cfg.GroupCommitWindow = DefaultPebbleDBConfig().SyncInterval
+	ro, err := NewPebbleStoreReadOnly(store.path, &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer ro.Close()
+
+	if cfg.ReadOnly {
+		t.Fatalf("caller's config was modified")
+	}
+
+	if last, _ := ro.LastIndex(); last != 2 {
+		t.Fatalf("bad: %d", last)
+	}
+	if err := ro.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if term, err := ro.GetUint64([]byte("CurrentTerm")); err != nil || term != 3 {
+		t.Fatalf("bad: %d %v", term, err)
+	}
+
+	for name, err := range map[string]error{
+		"StoreLogs":   ro.StoreLogs([]*raft.Log{testRaftLog(3, "log3")}),
+		"DeleteRange": ro.DeleteRange(1, 1),
+		"Set":         ro.Set([]byte("k"), []byte("v")),
+		"SetUint64":   ro.SetUint64([]byte("k"), 1),
+		"Sync":        ro.Sync(),
+	} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("%s: expected read-only error, got: %v", name, err)
+		}
+	}
+
+	if first, _ := ro.FirstIndex(); first != 1 {
+		t.Fatalf("bad: %d", first)
+	}
+}
+
+func TestPebbleStore_ReadOnlyMissingDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing")
+
+	if _, err := NewPebbleStoreReadOnly(path, &Logger{}, nil); err == nil {
+		t.Fatalf("expected error opening a missing store")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("read-only open created the directory: %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package raftpebbledb
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+// ErrNoRetention is returned by Retention when neither RetentionMaxBytes nor
+// RetentionMaxAge is configured.
+var ErrNoRetention = errors.New("no retention policy configured")
+
+// RetentionStatus is the size and age of a store's log against the retention
+// policy.
+type RetentionStatus struct {
+	// Entries and Bytes are the number and encoded size of the entries
+	// held, as written to pebble after compression and encryption.
+	Entries uint64
+	Bytes   uint64
+
+	FirstIndex uint64
+	LastIndex  uint64
+
+	// Oldest is the AppendedAt of the first entry, zero when unknown.
+	Oldest time.Time
+
+	// TruncateIndex is the last index to delete to bring the log within
+	// budget: entries up to it are beyond RetentionMaxBytes counting from
+	// the newest, or older than RetentionMaxAge. 0 when within budget.
+	// Raft can only drop entries covered by a snapshot, so the log is safe
+	// to truncate up to the lower of this and the last snapshot index.
+	TruncateIndex uint64
+}
+
+// Exceeded reports whether the log is over budget.
+func (s RetentionStatus) Exceeded() bool {
+	return s.TruncateIndex != 0
+}
+
+// retentionPolicy is the budget of every store's log, from PebbleDBConfig.
+type retentionPolicy struct {
+	maxBytes uint64
+	maxAge   time.Duration
+	hook     func(*PebbleStore, RetentionStatus)
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.maxBytes > 0 || p.maxAge > 0
+}
+
+// retentionTracker keeps the byte accounting of one store's log. It is
+// updated under the engine's write lock, after every commit of StoreLogs and
+// DeleteRange.
+type retentionTracker struct {
+	retentionPolicy
+
+	mu      sync.Mutex
+	entries uint64
+	bytes   uint64
+
+	// oldest caches the AppendedAt of the entry at oldestIndex, the first
+	// one when it was read
+	oldestIndex uint64
+	oldest      time.Time
+
+	// notified is set once the hook was called, until the log is back
+	// within budget
+	notified bool
+}
+
+// add moves the accounting by entries and bytes added, minus those removed.
+func (t *retentionTracker) add(entries, bytes, removedEntries, removedBytes uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries = t.entries + entries - min(removedEntries, t.entries+entries)
+	t.bytes = t.bytes + bytes - min(removedBytes, t.bytes+bytes)
+}
+
+// forget drops the cached AppendedAt when the entry it was read from may
+// have been overwritten by a write starting at min.
+func (t *retentionTracker) forget(min uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if min <= t.oldestIndex {
+		t.oldestIndex, t.oldest = 0, time.Time{}
+	}
+}
+
+func (t *retentionTracker) totals() (uint64, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.entries, t.bytes
+}
+
+// logSizes returns the number and total encoded size of the entries held in
+// [min, max].
+func (ps *PebbleStore) logSizes(min, max uint64) (uint64, uint64, error) {
+	iter, err := ps.db.NewIter(&pebble.IterOptions{
+		LowerBound: ps.buildKey(ps.logsPrefix, uint64ToBytes(min)),
+		UpperBound: ps.logIterUpperBound(max),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var entries, bytes uint64
+	for iter.First(); iter.Valid(); iter.Next() {
+		entries++
+		bytes += uint64(len(iter.Value()))
+	}
+
+	if err := iter.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	return entries, bytes, nil
+}
+
+// replacedSizes returns the number and total encoded size of the entries a
+// write of [min, max] overwrites: those held once the writes before it in
+// the same commit group are applied. written holds the encoded size of each
+// entry those writes stored, by index.
+func (ps *PebbleStore) replacedSizes(min, max uint64, written map[uint64]uint64) (uint64, uint64, error) {
+	var entries, bytes uint64
+
+	if min <= ps.lastIndex.Load() {
+		iter, err := ps.db.NewIter(&pebble.IterOptions{
+			LowerBound: ps.buildKey(ps.logsPrefix, uint64ToBytes(min)),
+			UpperBound: ps.logIterUpperBound(max),
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+
+		for iter.First(); iter.Valid(); iter.Next() {
+			if _, ok := written[bytesToUint64(ps.dblogKey(iter.Key()))]; ok {
+				continue
+			}
+			entries++
+			bytes += uint64(len(iter.Value()))
+		}
+
+		if err := iter.Close(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	for index, size := range written {
+		if index >= min && index <= max {
+			entries++
+			bytes += size
+		}
+	}
+
+	return entries, bytes, nil
+}
+
+// oldestAppendedAt returns the AppendedAt of the first entry, reading it only
+// when the first entry changed since the last call.
+func (ps *PebbleStore) oldestAppendedAt(first uint64) (time.Time, error) {
+	t := ps.retention
+
+	t.mu.Lock()
+	if t.oldestIndex == first {
+		oldest := t.oldest
+		t.mu.Unlock()
+		return oldest, nil
+	}
+	t.mu.Unlock()
+
+	if first == 0 {
+		return time.Time{}, nil
+	}
+
+	log := new(raft.Log)
+	if err := ps.readLog(first, log); err != nil {
+		return time.Time{}, err
+	}
+
+	t.mu.Lock()
+	t.oldestIndex, t.oldest = first, log.AppendedAt
+	t.mu.Unlock()
+
+	return log.AppendedAt, nil
+}
+
+// Retention reports the size and age of the log against the retention policy
+// set by RetentionMaxBytes and RetentionMaxAge, and how far to truncate it to
+// get back within budget. Entries without AppendedAt never count as too old.
+func (ps *PebbleStore) Retention() (RetentionStatus, error) {
+	if !ps.acquire() {
+		return RetentionStatus{}, pebble.ErrClosed
+	}
+	defer ps.release()
+
+	if ps.retention == nil {
+		return RetentionStatus{}, ErrNoRetention
+	}
+
+	return ps.retentionStatus()
+}
+
+func (ps *PebbleStore) retentionStatus() (RetentionStatus, error) {
+	t := ps.retention
+
+	status := RetentionStatus{
+		FirstIndex: ps.firstIndex.Load(),
+		LastIndex:  ps.lastIndex.Load(),
+	}
+	status.Entries, status.Bytes = t.totals()
+
+	over, oldest, err := ps.overBudget(status.FirstIndex, status.Bytes)
+	status.Oldest = oldest
+	if err != nil || !over {
+		return status, err
+	}
+
+	// Walk from the oldest entry until the rest fits in both budgets
+	iter, err := ps.db.NewIter(ps.logIterOptions())
+	if err != nil {
+		return status, err
+	}
+	defer iter.Close()
+
+	cutoff := time.Now().Add(-t.maxAge)
+	remaining := status.Bytes
+	log := new(raft.Log)
+	for iter.First(); iter.Valid(); iter.Next() {
+		index := bytesToUint64(ps.dblogKey(iter.Key()))
+
+		if t.maxBytes == 0 || remaining <= t.maxBytes {
+			if t.maxAge == 0 {
+				break
+			}
+
+			val, err := ps.engine.openLogValue(index, iter.Key(), iter.Value())
+			if err == nil {
+				err = ps.engine.codec.decode(index, val, log)
+			}
+			if err != nil {
+				return status, err
+			}
+			if log.AppendedAt.IsZero() || !log.AppendedAt.Before(cutoff) {
+				break
+			}
+		}
+
+		status.TruncateIndex = index
+		remaining -= min(remaining, uint64(len(iter.Value())))
+	}
+
+	return status, iter.Error()
+}
+
+// overBudget reports whether a log starting at first and holding bytes is
+// over budget, along with the AppendedAt of its first entry.
+func (ps *PebbleStore) overBudget(first, bytes uint64) (bool, time.Time, error) {
+	t := ps.retention
+
+	oldest, err := ps.oldestAppendedAt(first)
+	if err != nil {
+		return false, oldest, err
+	}
+
+	if t.maxBytes > 0 && bytes > t.maxBytes {
+		return true, oldest, nil
+	}
+
+	tooOld := t.maxAge > 0 && !oldest.IsZero() && time.Since(oldest) > t.maxAge
+
+	return tooOld, oldest, nil
+}
+
+// checkRetention calls the OnRetentionExceeded hook the first time the log
+// is found over budget, and rearms it once the log is back within budget.
+// It runs after every commit of StoreLogs and DeleteRange.
+func (ps *PebbleStore) checkRetention() {
+	t := ps.retention
+
+	_, bytes := t.totals()
+	over, _, err := ps.overBudget(ps.firstIndex.Load(), bytes)
+	if err != nil {
+		ps.logger.Infof("pebbledb retention check error: %s\n", err.Error())
+		return
+	}
+
+	t.mu.Lock()
+	notify := over && !t.notified && t.hook != nil
+	t.notified = over
+	t.mu.Unlock()
+
+	if !notify || !ps.acquire() {
+		return
+	}
+
+	// The hook may well call back into raft, which is waiting on this write
+	go func() {
+		status, err := ps.retentionStatus()
+		ps.release()
+		if err != nil {
+			ps.logger.Infof("pebbledb retention check error: %s\n", err.Error())
+			return
+		}
+		t.hook(ps, status)
+	}()
+}
+
+// initRetention counts the entries held when the store is opened. It counts
+// under the write lock and registers the tracker with the engine, so values
+// Reencrypt rewrites are either counted at their new size or moved by it.
+func (ps *PebbleStore) initRetention() error {
+	ps.engine.writeMu.Lock()
+	defer ps.engine.writeMu.Unlock()
+
+	entries, bytes, err := ps.logSizes(0, math.MaxUint64)
+	if err != nil {
+		return err
+	}
+
+	ps.retention.add(entries, bytes, 0, 0)
+	ps.engine.trackers[string(ps.logsPrefix)] = ps.retention
+
+	return nil
+}
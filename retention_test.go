@@ -0,0 +1,277 @@
+package raftpebbledb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// testCheckRetention verifies the retention count against a full scan.
+func testCheckRetention(t *testing.T, store *PebbleStore, wantEntries uint64) RetentionStatus {
+	t.Helper()
+
+	status, err := store.Retention()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entries, bytes, err := store.logSizes(0, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status.Entries != wantEntries || entries != wantEntries || status.Bytes != bytes {
+		t.Fatalf("bad: %+v, scanned %d entries of %d bytes", status, entries, bytes)
+	}
+
+	return status
+}
+
+func TestPebbleStore_RetentionAccounting(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.RetentionMaxBytes = math.MaxUint64
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	testStoreLogRange(t, store, 1, 100, 1, make([]byte, 100))
+	testCheckRetention(t, store, 100)
+
+	// Raft overwrites a conflicting suffix
+	testStoreLogRange(t, store, 90, 110, 1, make([]byte, 500))
+	testCheckRetention(t, store, 110)
+
+	if err := store.DeleteRange(1, 50); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.DeleteRange(100, 200); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testCheckRetention(t, store, 49)
+
+	store.Close()
+	store, err := NewPebbleStore(store.path, &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	testCheckRetention(t, store, 49)
+}
+
+func TestPebbleStore_RetentionMaxBytes(t *testing.T) {
+	exceeded := make(chan RetentionStatus, 10)
+
+	cfg := DefaultPebbleDBConfig()
+	cfg.RetentionMaxBytes = 10 * 1024
+	cfg.OnRetentionExceeded = func(store *PebbleStore, status RetentionStatus) {
+		exceeded <- status
+	}
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	testStoreLogRange(t, store, 1, 9, 1, make([]byte, 1024))
+	if status := testCheckRetention(t, store, 9); status.Exceeded() {
+		t.Fatalf("bad: %+v", status)
+	}
+
+	testStoreLogRange(t, store, 10, 21, 1, make([]byte, 1024))
+
+	var status RetentionStatus
+	select {
+	case status = <-exceeded:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("hook not called")
+	}
+	if status.TruncateIndex == 0 || status.Bytes <= cfg.RetentionMaxBytes {
+		t.Fatalf("bad: %+v", status)
+	}
+
+	// Called once while over budget
+	testStoreLogRange(t, store, 22, 22, 1, make([]byte, 1024))
+	select {
+	case status := <-exceeded:
+		t.Fatalf("called again: %+v", status)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Truncating up to TruncateIndex is enough, and just enough
+	if err := store.DeleteRange(22, 22); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.DeleteRange(1, status.TruncateIndex-1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status, _ := store.Retention(); !status.Exceeded() {
+		t.Fatalf("bad: %+v", status)
+	}
+	if err := store.DeleteRange(status.TruncateIndex, status.TruncateIndex); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status, _ := store.Retention(); status.Exceeded() || status.Bytes > cfg.RetentionMaxBytes {
+		t.Fatalf("bad: %+v", status)
+	}
+
+	// Back within budget, the hook is armed again
+	testStoreLogRange(t, store, 22, 40, 1, make([]byte, 1024))
+	select {
+	case <-exceeded:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("hook not called")
+	}
+}
+
+func TestPebbleStore_RetentionMaxAge(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.RetentionMaxAge = time.Hour
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	logs := testLogRange(1, 20, 1, make([]byte, 10))
+	for _, log := range logs {
+		log.AppendedAt = time.Now()
+		if log.Index <= 10 {
+			log.AppendedAt = old
+		}
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	status := testCheckRetention(t, store, 20)
+	if status.TruncateIndex != 10 || !status.Oldest.Equal(old) {
+		t.Fatalf("bad: %+v", status)
+	}
+
+	if err := store.DeleteRange(1, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status := testCheckRetention(t, store, 10); status.Exceeded() {
+		t.Fatalf("bad: %+v", status)
+	}
+
+	// Entries without AppendedAt are never too old
+	if err := store.DeleteRange(11, 20); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testStoreLogRange(t, store, 21, 30, 1, make([]byte, 10))
+	if status := testCheckRetention(t, store, 10); status.Exceeded() {
+		t.Fatalf("bad: %+v", status)
+	}
+}
+
+func TestPebbleStore_RetentionDisabled(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	if _, err := store.Retention(); !errors.Is(err, ErrNoRetention) {
+		t.Fatalf("expected no retention, got: %v", err)
+	}
+}
+
+func TestPebbleStore_RetentionGroupCommit(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.RetentionMaxBytes = math.MaxUint64
+	cfg.GroupCommitWindow = time.Minute
+
+	store, err := NewPebbleStoreInMemory(&Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Fills each group, so it commits without waiting out the window
+	commitGroup := func(writes ...func() error) {
+		t.Helper()
+
+		for i := len(writes); i < maxGroupCommitSize; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			writes = append(writes, func() error {
+				return store.SetUint64(key, 1)
+			})
+		}
+		for _, err := range testCommitConcurrently(writes) {
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+	}
+
+	commitGroup(func() error {
+		return store.StoreLogs(testLogRange(1, 10, 1, make([]byte, 100)))
+	})
+	testCheckRetention(t, store, 10)
+
+	// Both overwrite 8-10, and whichever comes second what the first wrote
+	commitGroup(func() error {
+		return store.StoreLogs(testLogRange(5, 12, 2, make([]byte, 500)))
+	}, func() error {
+		return store.StoreLogs(testLogRange(8, 15, 3, make([]byte, 700)))
+	})
+	testCheckRetention(t, store, 15)
+}
+
+func TestPebbleStore_RetentionReencrypt(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.RetentionMaxBytes = math.MaxUint64
+	cfg.KeyProvider = testKeyProvider(t, "a "+testKeyA)
+
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	testStoreLogRange(t, store, 1, 2*reencryptBatchSize+10, 1, make([]byte, 100))
+	store.Close()
+
+	// A longer key id makes every sealed value longer
+	cfg.KeyProvider = testKeyProvider(t, "longer-key-id "+testKeyB, "a "+testKeyA)
+	cfg.ReencryptOnOpen = true
+	store, err := NewPebbleStore(store.path, &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Finishes whatever the background rotation has not done yet
+	if _, err := store.Engine().Reencrypt(context.Background()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testCheckRetention(t, store, 2*reencryptBatchSize+10)
+
+	// Every group of an engine counts its own
+	cfg.ReencryptOnOpen = false
+	cfg.KeyProvider = testKeyProvider(t, "a "+testKeyA)
+	engine, err := NewPebbleEngine(t.TempDir(), &Logger{}, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer engine.Close()
+
+	var stores []*PebbleStore
+	for group := uint64(1); group <= 2; group++ {
+		store, err := engine.Store(group)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		testStoreLogRange(t, store, 1, 100*group, 1, make([]byte, 100))
+		stores = append(stores, store)
+	}
+
+	engine.cipher = newValueCipher(testKeyProvider(t, "longer-key-id "+testKeyB, "a "+testKeyA))
+	if _, err := engine.Reencrypt(context.Background()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i, store := range stores {
+		testCheckRetention(t, store, 100*uint64(i+1))
+	}
+}
@@ -0,0 +1,594 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+// snapshotChunkSize is the size of the values a snapshot body is split into.
+const snapshotChunkSize = 1 << 20
+
+// Key kinds under a store's __snaps__ bucket. A snapshot is visible once its
+// meta key is written; chunks without meta belong to an unfinished sink.
+const (
+	snapKindMeta  byte = 'm'
+	snapKindChunk byte = 'c'
+)
+
+// ErrSnapshotNotFound is returned by PebbleSnapshotStore.Open for an unknown
+// snapshot ID.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// pebbleSnapshotMeta is the JSON stored under a snapshot's meta key.
+type pebbleSnapshotMeta struct {
+	raft.SnapshotMeta
+	CRC       uint64
+	Chunks    uint64
+	Encrypted bool
+}
+
+// PebbleSnapshotStore implements raft.SnapshotStore inside the pebble db of
+// a PebbleStore, so logs, stable state and snapshots share one directory and
+// one WAL. Bodies are split into 1MB chunks and read back as a stream.
+//
+// Chunks are encrypted when the engine has a KeyProvider. Reencrypt does not
+// rotate them; keep retired keys until the snapshots sealed with them have
+// been replaced.
+type PebbleSnapshotStore struct {
+	store  *PebbleStore
+	retain int
+}
+
+var _ raft.SnapshotStore = (*PebbleSnapshotStore)(nil)
+
+// NewPebbleSnapshotStore returns a snapshot store keeping the retain most
+// recent snapshots of store's group. Chunks left behind by sinks that were
+// never closed, e.g. after a crash, are removed.
+func NewPebbleSnapshotStore(store *PebbleStore, retain int) (*PebbleSnapshotStore, error) {
+	if retain < 1 {
+		return nil, fmt.Errorf("must retain at least one snapshot")
+	}
+
+	if !store.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer store.release()
+
+	s := &PebbleSnapshotStore{store: store, retain: retain}
+	if err := s.reapOrphans(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *PebbleSnapshotStore) metaKey(id string) []byte {
+	return concatBytes(s.store.snapPrefix, append([]byte{snapKindMeta}, id...))
+}
+
+func (s *PebbleSnapshotStore) chunkPrefix(id string) []byte {
+	return concatBytes(s.store.snapPrefix, append(append([]byte{snapKindChunk}, id...), '/'))
+}
+
+func (s *PebbleSnapshotStore) chunkKey(id string, n uint64) []byte {
+	return concatBytes(s.chunkPrefix(id), uint64ToBytes(n))
+}
+
+// Create starts a new snapshot. It is only visible to List and Open once the
+// sink is closed.
+func (s *PebbleSnapshotStore) Create(version raft.SnapshotVersion, index, term uint64,
+	configuration raft.Configuration, configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+	if version < raft.SnapshotVersionMin || version > raft.SnapshotVersionMax {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	if !s.store.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer s.store.release()
+
+	id := fmt.Sprintf("%d-%d-%d", term, index, time.Now().UnixMilli())
+
+	return &pebbleSnapshotSink{
+		store: s,
+		meta: pebbleSnapshotMeta{
+			SnapshotMeta: raft.SnapshotMeta{
+				Version:            version,
+				ID:                 id,
+				Index:              index,
+				Term:               term,
+				Peers:              encodePeers(configuration, trans),
+				Configuration:      configuration,
+				ConfigurationIndex: configurationIndex,
+			},
+			Encrypted: s.store.engine.cipher != nil,
+		},
+		hash: crc64.New(crc64Table),
+		buf:  make([]byte, 0, snapshotChunkSize),
+	}, nil
+}
+
+// encodePeers is the legacy peer list kept in SnapshotMeta for protocol
+// version 0, built the same way raft's own snapshot stores do.
+func encodePeers(configuration raft.Configuration, trans raft.Transport) []byte {
+	var peers []string
+	for _, server := range configuration.Servers {
+		if server.Suffrage == raft.Voter {
+			peers = append(peers, string(trans.EncodePeer(server.ID, server.Address)))
+		}
+	}
+
+	buf, err := encodeMsgPack(peers)
+	if err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// List returns the retained snapshots, newest first.
+func (s *PebbleSnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	metas, err := s.metas()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metas) > s.retain {
+		metas = metas[:s.retain]
+	}
+
+	out := make([]*raft.SnapshotMeta, 0, len(metas))
+	for _, meta := range metas {
+		out = append(out, &meta.SnapshotMeta)
+	}
+
+	return out, nil
+}
+
+// metas returns every complete snapshot, newest first.
+func (s *PebbleSnapshotStore) metas() ([]*pebbleSnapshotMeta, error) {
+	if !s.store.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer s.store.release()
+
+	prefix := concatBytes(s.store.snapPrefix, []byte{snapKindMeta})
+	iter, err := s.store.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var metas []*pebbleSnapshotMeta
+	for iter.First(); iter.Valid(); iter.Next() {
+		meta := new(pebbleSnapshotMeta)
+		if err := json.Unmarshal(iter.Value(), meta); err != nil {
+			s.store.logger.Infof("pebbledb snapshot %q has bad metadata: %s\n", iter.Key()[len(prefix):], err.Error())
+			continue
+		}
+
+		if meta.Version < raft.SnapshotVersionMin || meta.Version > raft.SnapshotVersionMax {
+			continue
+		}
+
+		metas = append(metas, meta)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		a, b := metas[i], metas[j]
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		return a.ID > b.ID
+	})
+
+	return metas, nil
+}
+
+// Open returns the metadata and a streaming reader of a snapshot. The reader
+// verifies the body's checksum when it reaches the end and must be closed.
+func (s *PebbleSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	// The reader keeps the store busy until it is closed
+	if !s.store.acquire() {
+		return nil, nil, pebble.ErrClosed
+	}
+	release := true
+	defer func() {
+		if release {
+			s.store.release()
+		}
+	}()
+
+	val, closer, err := s.store.db.Get(s.metaKey(id))
+	if err == pebble.ErrNotFound {
+		return nil, nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := new(pebbleSnapshotMeta)
+	err = json.Unmarshal(val, meta)
+	closer.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prefix := s.chunkPrefix(id)
+	iter, err := s.store.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	release = false
+
+	return &meta.SnapshotMeta, &pebbleSnapshotReader{
+		store: s,
+		meta:  meta,
+		iter:  iter,
+		hash:  crc64.New(crc64Table),
+	}, nil
+}
+
+// reap deletes every snapshot beyond the retain most recent ones.
+func (s *PebbleSnapshotStore) reap() error {
+	metas, err := s.metas()
+	if err != nil || len(metas) <= s.retain {
+		return err
+	}
+
+	batch := s.store.db.NewBatch()
+	defer batch.Close()
+
+	for _, meta := range metas[s.retain:] {
+		if err := s.deleteSnapshot(batch, meta.ID); err != nil {
+			return err
+		}
+	}
+
+	return s.commit(batch, false)
+}
+
+// reapOrphans deletes chunks that have no meta key.
+func (s *PebbleSnapshotStore) reapOrphans() error {
+	prefix := concatBytes(s.store.snapPrefix, []byte{snapKindChunk})
+	iter, err := s.store.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	batch := s.store.db.NewBatch()
+	defer batch.Close()
+
+	for valid := iter.First(); valid; {
+		rest := iter.Key()[len(prefix):]
+		end := bytes.IndexByte(rest, '/')
+		if end < 0 {
+			valid = iter.Next()
+			continue
+		}
+
+		id := string(rest[:end])
+		_, closer, err := s.store.db.Get(s.metaKey(id))
+		if err == pebble.ErrNotFound {
+			s.store.logger.Infof("pebbledb removing unfinished snapshot %s\n", id)
+			if err := batch.DeleteRange(s.chunkPrefix(id), prefixUpperBound(s.chunkPrefix(id)), nil); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			closer.Close()
+		}
+
+		// Skip the remaining chunks of this snapshot
+		valid = iter.SeekGE(prefixUpperBound(s.chunkPrefix(id)))
+	}
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if batch.Empty() {
+		return nil
+	}
+
+	return s.commit(batch, false)
+}
+
+func (s *PebbleSnapshotStore) deleteSnapshot(batch *pebble.Batch, id string) error {
+	prefix := s.chunkPrefix(id)
+	if err := batch.DeleteRange(prefix, prefixUpperBound(prefix), nil); err != nil {
+		return err
+	}
+	return batch.Delete(s.metaKey(id), nil)
+}
+
+// commit commits batch unless the engine is degraded. Snapshot metadata is
+// always synced, whatever the durability mode, because raft compacts its log
+// once a snapshot has been persisted.
+func (s *PebbleSnapshotStore) commit(batch *pebble.Batch, sync bool) error {
+	if err := s.store.engine.writable(); err != nil {
+		return err
+	}
+
+	opts := pebble.NoSync
+	if sync {
+		opts = pebble.Sync
+	}
+
+	return batch.Commit(opts)
+}
+
+// pebbleSnapshotSink buffers a snapshot body and writes it one chunk at a
+// time. Close publishes the metadata, Cancel drops the written chunks.
+type pebbleSnapshotSink struct {
+	store *PebbleSnapshotStore
+	meta  pebbleSnapshotMeta
+	hash  hash.Hash64
+	buf   []byte
+	done  bool
+}
+
+func (sink *pebbleSnapshotSink) ID() string {
+	return sink.meta.ID
+}
+
+func (sink *pebbleSnapshotSink) Write(p []byte) (int, error) {
+	if sink.done {
+		return 0, errors.New("snapshot sink is closed")
+	}
+
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), snapshotChunkSize-len(sink.buf))
+		sink.buf = append(sink.buf, p[:n]...)
+		p = p[n:]
+
+		if len(sink.buf) == snapshotChunkSize {
+			if err := sink.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (sink *pebbleSnapshotSink) flush() error {
+	if len(sink.buf) == 0 {
+		return nil
+	}
+
+	s := sink.store
+	if !s.store.acquire() {
+		return pebble.ErrClosed
+	}
+	defer s.store.release()
+
+	sink.hash.Write(sink.buf)
+
+	key := s.chunkKey(sink.meta.ID, sink.meta.Chunks)
+	val, err := s.store.engine.sealValue(key, sink.buf)
+	if err != nil {
+		return err
+	}
+
+	batch := s.store.db.NewBatch()
+	defer batch.Close()
+
+	if err := batch.Set(key, val, nil); err != nil {
+		return err
+	}
+
+	if err := s.commit(batch, false); err != nil {
+		return err
+	}
+
+	sink.meta.Size += int64(len(sink.buf))
+	sink.meta.Chunks++
+	sink.buf = sink.buf[:0]
+
+	return nil
+}
+
+// Close writes the last chunk and the metadata, then removes snapshots beyond
+// the retention count.
+func (sink *pebbleSnapshotSink) Close() error {
+	if sink.done {
+		return nil
+	}
+	sink.done = true
+
+	s := sink.store
+	if !s.store.acquire() {
+		return pebble.ErrClosed
+	}
+	defer s.store.release()
+
+	if err := sink.flush(); err != nil {
+		sink.discard()
+		return err
+	}
+
+	sink.meta.CRC = sink.hash.Sum64()
+	buf, err := json.Marshal(&sink.meta)
+	if err != nil {
+		sink.discard()
+		return err
+	}
+
+	batch := s.store.db.NewBatch()
+	defer batch.Close()
+
+	if err := batch.Set(s.metaKey(sink.meta.ID), buf, nil); err != nil {
+		sink.discard()
+		return err
+	}
+
+	// The WAL is sequential, so syncing the meta also syncs every chunk
+	if err := s.commit(batch, true); err != nil {
+		sink.discard()
+		return err
+	}
+
+	return s.reap()
+}
+
+// Cancel abandons the snapshot and deletes what has been written so far.
+func (sink *pebbleSnapshotSink) Cancel() error {
+	if sink.done {
+		return nil
+	}
+	sink.done = true
+
+	return sink.discard()
+}
+
+func (sink *pebbleSnapshotSink) discard() error {
+	s := sink.store
+	if !s.store.acquire() {
+		return pebble.ErrClosed
+	}
+	defer s.store.release()
+
+	prefix := s.chunkPrefix(sink.meta.ID)
+
+	batch := s.store.db.NewBatch()
+	defer batch.Close()
+
+	if err := batch.DeleteRange(prefix, prefixUpperBound(prefix), nil); err != nil {
+		return err
+	}
+
+	return s.commit(batch, false)
+}
+
+// pebbleSnapshotReader streams the chunks of a snapshot from a single
+// iterator, which also pins them against a concurrent reap.
+type pebbleSnapshotReader struct {
+	store *PebbleSnapshotStore
+	meta  *pebbleSnapshotMeta
+	iter  *pebble.Iterator
+	hash  hash.Hash64
+
+	chunk []byte
+	next  uint64
+	read  int64
+	err   error
+}
+
+func (r *pebbleSnapshotReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	for len(r.chunk) == 0 {
+		if r.err = r.nextChunk(); r.err != nil {
+			return 0, r.err
+		}
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+
+	return n, nil
+}
+
+// nextChunk loads the next chunk into r.chunk, or returns io.EOF once the
+// body has been read and verified.
+func (r *pebbleSnapshotReader) nextChunk() error {
+	var valid bool
+	if r.next == 0 {
+		valid = r.iter.First()
+	} else {
+		valid = r.iter.Next()
+	}
+
+	if !valid {
+		if err := r.iter.Error(); err != nil {
+			return err
+		}
+		return r.verify()
+	}
+
+	key := r.iter.Key()
+	if !bytes.Equal(key, r.store.chunkKey(r.meta.ID, r.next)) {
+		return fmt.Errorf("snapshot %s: missing chunk %d", r.meta.ID, r.next)
+	}
+
+	chunk := r.iter.Value()
+	if r.meta.Encrypted {
+		if r.store.store.engine.cipher == nil {
+			return ErrNoKeyProvider
+		}
+
+		var err error
+		if chunk, _, err = r.store.store.engine.cipher.open(key, chunk); err != nil {
+			return fmt.Errorf("snapshot %s chunk %d: %w", r.meta.ID, r.next, err)
+		}
+	}
+
+	r.hash.Write(chunk)
+	r.read += int64(len(chunk))
+	r.next++
+	r.chunk = chunk
+
+	return nil
+}
+
+func (r *pebbleSnapshotReader) verify() error {
+	if r.next != r.meta.Chunks || r.read != r.meta.Size {
+		return fmt.Errorf("snapshot %s: read %d bytes in %d chunks, expected %d in %d",
+			r.meta.ID, r.read, r.next, r.meta.Size, r.meta.Chunks)
+	}
+
+	if r.hash.Sum64() != r.meta.CRC {
+		return fmt.Errorf("snapshot %s: %w", r.meta.ID, errChecksumMismatch)
+	}
+
+	return io.EOF
+}
+
+func (r *pebbleSnapshotReader) Close() error {
+	if r.iter == nil {
+		return nil
+	}
+
+	err := r.iter.Close()
+	r.iter = nil
+	r.store.store.release()
+	if r.err == nil || r.err == io.EOF {
+		r.err = errors.New("snapshot reader is closed")
+	}
+
+	return err
+}
@@ -0,0 +1,223 @@
+package raftpebbledb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func testSnapshotStore(t *testing.T, retain int) (*PebbleStore, *PebbleSnapshotStore) {
+	store := testPebbleStore(t)
+	snaps, err := NewPebbleSnapshotStore(store, retain)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return store, snaps
+}
+
+func testCreateSnapshot(t *testing.T, snaps *PebbleSnapshotStore, index uint64, body []byte) string {
+	_, trans := raft.NewInmemTransport("")
+	configuration := raft.Configuration{Servers: []raft.Server{{ID: "a", Address: "a", Suffrage: raft.Voter}}}
+
+	sink, err := snaps.Create(raft.SnapshotVersionMax, index, 3, configuration, 2, trans)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := sink.Write(body); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return sink.ID()
+}
+
+func TestPebbleSnapshotStore_CreateOpen(t *testing.T) {
+	store, snaps := testSnapshotStore(t, 2)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	// Spans several chunks and ends in a partial one
+	body := randomBytes(2*snapshotChunkSize + 100)
+	id := testCreateSnapshot(t, snaps, 10, body)
+
+	list, err := snaps.List()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(list) != 1 || list[0].ID != id || list[0].Index != 10 || list[0].Term != 3 ||
+		list[0].Size != int64(len(body)) || len(list[0].Configuration.Servers) != 1 {
+		t.Fatalf("bad: %#v", list)
+	}
+
+	meta, r, err := snaps.Open(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+
+	if meta.ConfigurationIndex != 2 {
+		t.Fatalf("bad: %#v", meta)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("bad body of %d bytes", len(got))
+	}
+
+	if _, _, err := snaps.Open("nope"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestPebbleSnapshotStore_Retain(t *testing.T) {
+	store, snaps := testSnapshotStore(t, 2)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	var ids []string
+	for i := uint64(1); i <= 4; i++ {
+		ids = append(ids, testCreateSnapshot(t, snaps, i*10, []byte("data")))
+	}
+
+	list, err := snaps.List()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(list) != 2 || list[0].ID != ids[3] || list[1].ID != ids[2] {
+		t.Fatalf("bad: %#v", list)
+	}
+
+	if _, _, err := snaps.Open(ids[0]); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+
+	// No chunks of reaped snapshots remain
+	prefix := snaps.chunkPrefix(ids[0])
+	iter, _ := store.db.NewIter(nil)
+	defer iter.Close()
+	if iter.SeekGE(prefix); iter.Valid() && bytes.HasPrefix(iter.Key(), prefix) {
+		t.Fatalf("chunks of reaped snapshot remain")
+	}
+}
+
+func TestPebbleSnapshotStore_CancelAndOrphans(t *testing.T) {
+	store, snaps := testSnapshotStore(t, 2)
+	defer os.RemoveAll(store.path)
+
+	_, trans := raft.NewInmemTransport("")
+	sink, err := snaps.Create(raft.SnapshotVersionMax, 10, 3, raft.Configuration{}, 2, trans)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := sink.Write(randomBytes(snapshotChunkSize + 1)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := sink.Cancel(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A sink that is never closed leaves its full chunks behind
+	sink, _ = snaps.Create(raft.SnapshotVersionMax, 20, 3, raft.Configuration{}, 2, trans)
+	sink.Write(randomBytes(snapshotChunkSize))
+
+	if list, _ := snaps.List(); len(list) != 0 {
+		t.Fatalf("bad: %#v", list)
+	}
+
+	countChunks := func() int {
+		iter, _ := store.db.NewIter(nil)
+		defer iter.Close()
+		n := 0
+		for iter.First(); iter.Valid(); iter.Next() {
+			if bytes.HasPrefix(iter.Key(), store.snapPrefix) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := countChunks(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	store.Close()
+
+	store, err = NewPebbleStore(store.path, &Logger{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if _, err := NewPebbleSnapshotStore(store, 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := countChunks(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestPebbleSnapshotStore_Corrupt(t *testing.T) {
+	store, snaps := testSnapshotStore(t, 2)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	id := testCreateSnapshot(t, snaps, 10, []byte("snapshot data"))
+
+	key := snaps.chunkKey(id, 0)
+	if err := store.db.Set(key, []byte("snapshot dada"), nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, r, err := snaps.Open(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+
+	if _, err := io.ReadAll(r); !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("expected checksum error, got: %v", err)
+	}
+}
+
+func TestPebbleSnapshotStore_Encrypted(t *testing.T) {
+	cfg := DefaultPebbleDBConfig()
+	cfg.KeyProvider = testKeyProvider(t, "a "+testKeyA)
+	store := testPebbleStoreWithConfig(t, cfg)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	snaps, err := NewPebbleSnapshotStore(store, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	id := testCreateSnapshot(t, snaps, 10, []byte("secret snapshot"))
+
+	val, _ := store.getBytes(snaps.chunkKey(id, 0))
+	if bytes.Contains(val, []byte("secret")) {
+		t.Fatalf("chunk is not encrypted")
+	}
+
+	_, r, err := snaps.Open(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "secret snapshot" {
+		t.Fatalf("bad: %q %v", got, err)
+	}
+
+	// Reencrypt leaves snapshot chunks alone
+	if _, err := store.Engine().Reencrypt(context.Background()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
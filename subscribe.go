@@ -0,0 +1,296 @@
+package raftpebbledb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/raft"
+)
+
+// ErrCompacted is returned by Subscribe and Subscription.Next when the entry
+// to deliver precedes the first entry held, as found once raft compacted the
+// log past it. With ArchiveDir set it can still be read from the store's
+// LogArchive.
+var ErrCompacted = errors.New("log entries compacted")
+
+// ErrSubscriptionClosed is returned by Subscription.Next once the
+// subscription is closed.
+var ErrSubscriptionClosed = errors.New("subscription closed")
+
+// logFeed tells the subscriptions of a store about new and removed entries.
+// It is updated under the engine's writeMu after every commit of StoreLogs
+// and DeleteRange.
+type logFeed struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+
+	// wakec is closed, and replaced, to wake every waiting subscription
+	wakec chan struct{}
+}
+
+func newLogFeed() *logFeed {
+	return &logFeed{
+		subs:  make(map[*Subscription]struct{}),
+		wakec: make(chan struct{}),
+	}
+}
+
+// wake wakes every waiting subscription. The caller holds mu.
+func (f *logFeed) wake() {
+	close(f.wakec)
+	f.wakec = make(chan struct{})
+}
+
+// broadcast wakes the subscriptions to find out the store was closed.
+func (f *logFeed) broadcast() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.wake()
+}
+
+// stored is called once entries from min on have been written, overwriting
+// the ones held when overwrote is set. Entries a subscription already
+// delivered were overwritten by a new leader and are delivered again.
+func (f *logFeed) stored(min uint64, overwrote bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.subs) == 0 {
+		return
+	}
+
+	if overwrote {
+		f.rewind(min)
+	}
+	f.wake()
+}
+
+// deleted is called once the entries held in [lo, hi] have been deleted,
+// tail telling whether entries after hi are still held. The store cannot
+// tell a compaction from a conflicting suffix, which raft may also delete
+// from the first entry on, so subscriptions move back to lo in case the
+// entries are stored again. Those past hi keep their place while the entries
+// after it are held. A subscription back before the first entry finds out it
+// was compacted when it reads.
+func (f *logFeed) deleted(lo, hi uint64, tail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.subs) == 0 {
+		return
+	}
+
+	for s := range f.subs {
+		if s.next > lo && (!tail || s.next <= hi) {
+			s.next = lo
+			s.gen++
+		}
+	}
+	f.wake()
+}
+
+// rewind moves subscriptions past min back to it. The caller holds mu.
+func (f *logFeed) rewind(min uint64) {
+	for s := range f.subs {
+		if s.next > min {
+			s.next = min
+			s.gen++
+		}
+	}
+}
+
+// Subscription follows a store's log from an index on, see
+// PebbleStore.Subscribe. It is not safe for concurrent use by multiple
+// goroutines, but may be closed from any goroutine.
+type Subscription struct {
+	store *PebbleStore
+	feed  *logFeed
+
+	// next is the index Next delivers, 0 for the first one stored in a log
+	// that was empty, and gen counts the times it was moved back by a
+	// rewind. Guarded by feed.mu.
+	next   uint64
+	gen    uint64
+	closed bool
+}
+
+// Subscribe returns a Subscription delivering the entries of the log from
+// fromIndex on; 0 starts at the first entry held or, in an empty log, at the
+// first one stored. Next replays the entries already stored and then waits
+// for the ones StoreLogs commits, so a sidecar can follow the log without
+// being part of the FSM.
+//
+// Entries are delivered as stored, which includes entries raft has not
+// committed yet. When a new leader overwrites them, or raft deletes them as a
+// conflicting suffix, Next delivers the replacements again from the first
+// overwritten index: an index not greater than the previous one means the
+// entries from it on replace those delivered before. Once the first entry
+// held is past the next entry to deliver, as raft compacted the log, Next
+// returns ErrCompacted; Subscribe returns it right away for an index before
+// the first entry held. While the log is empty, after raft deleted all of
+// it, Next waits to find out whether the entries are stored again.
+func (ps *PebbleStore) Subscribe(fromIndex uint64) (*Subscription, error) {
+	if !ps.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer ps.release()
+
+	// Registered under writeMu, so no commit can land between reading
+	// the first index and the subscription seeing its notifications
+	ps.engine.writeMu.Lock()
+	defer ps.engine.writeMu.Unlock()
+
+	f := ps.feed
+	first := ps.firstIndex.Load()
+
+	if fromIndex == 0 {
+		fromIndex = first
+	}
+
+	s := &Subscription{store: ps, feed: f, next: fromIndex}
+	if fromIndex != 0 {
+		if err := s.checkCompacted(fromIndex, first); err != nil {
+			return nil, err
+		}
+	}
+
+	f.mu.Lock()
+	f.subs[s] = struct{}{}
+	f.mu.Unlock()
+
+	return s, nil
+}
+
+// checkCompacted returns ErrCompacted when the entry at index precedes the
+// log starting at first. An empty log may still have it stored again.
+func (s *Subscription) checkCompacted(index, first uint64) error {
+	if first != 0 && index < first {
+		return fmt.Errorf("%w: index %d, first index is %d", ErrCompacted, index, first)
+	}
+
+	return nil
+}
+
+// Next returns the next entry, waiting for it to be stored if need be. It
+// returns ctx's error once ctx is done, ErrSubscriptionClosed once the
+// subscription is closed and pebble.ErrClosed once the store is. The
+// returned log is the caller's to keep.
+func (s *Subscription) Next(ctx context.Context) (*raft.Log, error) {
+	for {
+		s.feed.mu.Lock()
+		index, gen, closed, wakec := s.next, s.gen, s.closed, s.feed.wakec
+		s.feed.mu.Unlock()
+
+		if closed {
+			return nil, ErrSubscriptionClosed
+		}
+
+		log, err := s.read(index)
+		if err != nil {
+			return nil, err
+		}
+
+		if log != nil {
+			s.feed.mu.Lock()
+			current := s.gen == gen
+			if current {
+				s.next = log.Index + 1
+			}
+			s.feed.mu.Unlock()
+
+			// Overwritten while it was read, read the replacement
+			if !current {
+				continue
+			}
+			return log, nil
+		}
+
+		select {
+		case <-wakec:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// read returns the entry at index, or the first one after it when the log
+// has a gap there. It returns nil when there is none yet.
+func (s *Subscription) read(index uint64) (*raft.Log, error) {
+	ps := s.store
+	if !ps.acquire() {
+		return nil, pebble.ErrClosed
+	}
+	defer ps.release()
+
+	log := new(raft.Log)
+
+	if index == 0 {
+		first := ps.firstIndex.Load()
+		if first == 0 {
+			return nil, nil
+		}
+		// Compacted since it was read, the feed has woken the subscription
+		if err := ps.readLog(first, log); err != nil {
+			if errors.Is(err, raft.ErrLogNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return log, nil
+	}
+
+	err := ps.readLog(index, log)
+	if err == nil || !errors.Is(err, raft.ErrLogNotFound) {
+		return log, err
+	}
+
+	if err := s.checkCompacted(index, ps.firstIndex.Load()); err != nil {
+		return nil, err
+	}
+	if index > ps.lastIndex.Load() {
+		return nil, nil
+	}
+
+	// A DeleteRange holds writeMu from deleting the entries to updating the
+	// indexes and the feed, so a compacted entry is never taken for a gap
+	ps.engine.writeMu.Lock()
+	defer ps.engine.writeMu.Unlock()
+
+	first, last := ps.firstIndex.Load(), ps.lastIndex.Load()
+	if err := s.checkCompacted(index, first); err != nil {
+		return nil, err
+	}
+	if last == 0 || index > last {
+		return nil, nil
+	}
+
+	next, err := ps.seekIndex(index, true)
+	if err != nil || next == 0 {
+		return nil, err
+	}
+
+	if err := ps.readLog(next, log); err != nil {
+		return nil, err
+	}
+
+	return log, nil
+}
+
+// Close stops the subscription; a Next waiting for an entry returns
+// ErrSubscriptionClosed.
+func (s *Subscription) Close() error {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		delete(s.feed.subs, s)
+		s.feed.wake()
+	}
+
+	return nil
+}
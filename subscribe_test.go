@@ -0,0 +1,252 @@
+package raftpebbledb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// testNext reads the next entry of s and checks its index and term.
+func testNext(t *testing.T, s *Subscription, index, term uint64) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	log, err := s.Next(ctx)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if log.Index != index || log.Term != term {
+		t.Fatalf("bad: index %d term %d, expected index %d term %d", log.Index, log.Term, index, term)
+	}
+}
+
+func TestPebbleStore_Subscribe(t *testing.T) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		cfg := DefaultPebbleDBConfig()
+		cfg.GroupCommitWindow = window
+
+		store := testPebbleStoreWithConfig(t, cfg)
+		defer os.RemoveAll(store.path)
+		defer store.Close()
+
+		testStoreLogRange(t, store, 1, 10, 1, []byte("log"))
+
+		s, err := store.Subscribe(3)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer s.Close()
+
+		// Replays what is stored
+		for i := uint64(3); i <= 10; i++ {
+			testNext(t, s, i, 1)
+		}
+
+		// Then follows the writes
+		errc := make(chan error, 1)
+		go func() {
+			for i := uint64(11); i < 511; i += 10 {
+				if err := store.StoreLogs(testLogRange(i, i+9, 1, nil)); err != nil {
+					errc <- err
+					return
+				}
+			}
+			errc <- nil
+		}()
+
+		for i := uint64(11); i <= 510; i++ {
+			testNext(t, s, i, 1)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// Nothing more to read
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err = s.Next(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got: %v", err)
+		}
+	}
+}
+
+func TestPebbleStore_SubscribeCompacted(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	testStoreLogRange(t, store, 1, 20, 1, []byte("log"))
+
+	s, err := store.Subscribe(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Close()
+
+	for i := uint64(1); i <= 4; i++ {
+		testNext(t, s, i, 1)
+	}
+
+	if err := store.DeleteRange(1, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := s.Next(context.Background()); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected compacted, got: %v", err)
+	}
+	if _, err := store.Subscribe(5); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected compacted, got: %v", err)
+	}
+
+	// 0 starts at the first entry held
+	s, err = store.Subscribe(0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Close()
+	testNext(t, s, 11, 1)
+
+	// Compacting everything, as installing a snapshot does, is only told
+	// apart from a conflicting suffix once the log resumes after it
+	if err := store.DeleteRange(11, 20); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resumed, err := store.Subscribe(0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resumed.Close()
+
+	testStoreLogRange(t, store, 101, 102, 2, []byte("log"))
+	if _, err := s.Next(context.Background()); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected compacted, got: %v", err)
+	}
+	testNext(t, resumed, 101, 2)
+}
+
+func TestPebbleStore_SubscribeReplacedLog(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	testStoreLogRange(t, store, 1, 3, 1, []byte("log"))
+
+	s, err := store.Subscribe(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Close()
+
+	for i := uint64(1); i <= 3; i++ {
+		testNext(t, s, i, 1)
+	}
+
+	// A follower holding only uncommitted entries drops them all as a
+	// conflicting suffix starting at the first entry
+	if err := store.DeleteRange(1, 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Entry 1 may still be stored again
+	again, err := store.Subscribe(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer again.Close()
+
+	testStoreLogRange(t, store, 1, 4, 2, []byte("log"))
+	for i := uint64(1); i <= 4; i++ {
+		testNext(t, s, i, 2)
+		testNext(t, again, i, 2)
+	}
+
+	// Compacting the front keeps subscriptions past it in place
+	if err := store.DeleteRange(1, 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testStoreLogRange(t, store, 5, 5, 2, []byte("log"))
+	testNext(t, s, 5, 2)
+}
+
+func TestPebbleStore_SubscribeOverwrite(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+	defer store.Close()
+
+	testStoreLogRange(t, store, 1, 10, 1, []byte("log"))
+
+	s, err := store.Subscribe(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		testNext(t, s, i, 1)
+	}
+
+	// A new leader overwrites the tail
+	testStoreLogRange(t, store, 8, 12, 2, []byte("log"))
+	for i := uint64(8); i <= 12; i++ {
+		testNext(t, s, i, 2)
+	}
+
+	// Raft drops a conflicting suffix and stores the replacement
+	if err := store.DeleteRange(11, 12); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testStoreLogRange(t, store, 11, 11, 3, []byte("log"))
+	testNext(t, s, 11, 3)
+
+	// A gap is skipped
+	testStoreLogRange(t, store, 20, 20, 3, []byte("log"))
+	testNext(t, s, 20, 3)
+}
+
+func TestPebbleStore_SubscribeClose(t *testing.T) {
+	store := testPebbleStore(t)
+	defer os.RemoveAll(store.path)
+
+	s, err := store.Subscribe(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Next(context.Background())
+		errc <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	if err := <-errc; !errors.Is(err, ErrSubscriptionClosed) {
+		t.Fatalf("expected subscription closed, got: %v", err)
+	}
+
+	s, err = store.Subscribe(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer s.Close()
+
+	go func() {
+		_, err := s.Next(context.Background())
+		errc <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := <-errc; !errors.Is(err, pebble.ErrClosed) {
+		t.Fatalf("expected closed, got: %v", err)
+	}
+}
@@ -19,6 +19,29 @@ func uint64ToBytes(u uint64) []byte {
 	return buf
 }
 
+// concatBytes returns a new slice holding a followed by b, never sharing
+// memory with either
+func concatBytes(a, b []byte) []byte {
+	buf := make([]byte, len(a)+len(b))
+	copy(buf, a)
+	copy(buf[len(a):], b)
+	return buf
+}
+
+// prefixUpperBound returns the smallest key greater than every key that has
+// the given prefix, for use as an exclusive iterator upper bound
+func prefixUpperBound(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 // Decode reverses the encode operation on a byte slice input
 func decodeMsgPack(buf []byte, out interface{}) error {
 	r := bytes.NewBuffer(buf)